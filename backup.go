@@ -0,0 +1,341 @@
+/*
+Backup and restore of a whole GoPics instance.
+
+Copyright (c) 2015, Luca Chiricozzi. All rights reserved.
+Released under the MIT License.
+http://opensource.org/licenses/MIT
+*/
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Names of the entries of a backup archive. The archive is a gzipped tar
+// with the data as JSON, the media files under media/ and, as the last
+// entry, the SHA-256 checksums of all the other entries in the format
+// of sha256sum.
+const (
+	archiveData   = "gopics.json"
+	archiveMedia  = "media/"
+	archiveChecks = "SHA256SUMS"
+)
+
+// cmdExport writes the data of the Store selected by -store and the
+// media files of its posts to the archive named by args[0].
+func cmdExport(args []string) error {
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	s, err := newStore(*storeBackend)
+	if err != nil {
+		return err
+	}
+	snap, err := s.Snapshot(context.Background())
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	sums := new(bytes.Buffer)
+
+	// add writes an entry with the content of r to the archive and
+	// records its checksum.
+	add := func(name string, size int64, r io.Reader) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    size,
+			ModTime: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+
+		h := sha256.New()
+		if _, err = io.Copy(tw, io.TeeReader(r, h)); err != nil {
+			return err
+		}
+		fmt.Fprintf(sums, "%x  %s\n", h.Sum(nil), name)
+		return nil
+	}
+
+	if err = add(archiveData, int64(len(data)), bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	for _, p := range snap.Posts {
+		for _, name := range p.Media() {
+			err := addMediaFile(name, add)
+			if os.IsNotExist(err) {
+				log.Printf("export: media file %s of %s is missing",
+					name, p.AuthorName)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    archiveChecks,
+		Mode:    0644,
+		Size:    int64(sums.Len()),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = sums.WriteTo(tw); err != nil {
+		return err
+	}
+
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	log.Printf("export: %d users and %d posts written to %s",
+		len(snap.Users), len(snap.Posts), args[0])
+	return nil
+}
+
+// addMediaFile passes the media file with the given name to add.
+func addMediaFile(name string,
+	add func(name string, size int64, r io.Reader) error) error {
+	f, err := os.Open(buildFilePath(mediaPath, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return add(archiveMedia+name, info.Size(), f)
+}
+
+// readArchive reads the archive at path, calling fn for each entry but
+// the checksums. It returns ErrArchive if the entries do not match their
+// checksums, if an entry has no checksum or a checksum has no entry, or
+// if two entries have the same name. The checksums are the last entry,
+// so fn must not act on what it reads before readArchive returns nil.
+func readArchive(path string, fn func(h *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+
+	sums := make(map[string]string)
+	var checks []byte
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if h.Name == archiveChecks {
+			if checks, err = ioutil.ReadAll(tr); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, ok := sums[h.Name]; ok {
+			log.Printf("import: duplicate entry %s", h.Name)
+			return ErrArchive
+		}
+
+		sum := sha256.New()
+		if err = fn(h, io.TeeReader(tr, sum)); err != nil {
+			return err
+		}
+		// Hash what fn did not read.
+		if _, err = io.Copy(sum, tr); err != nil {
+			return err
+		}
+		sums[h.Name] = hex.EncodeToString(sum.Sum(nil))
+	}
+
+	// Compare the checksums
+	if checks == nil {
+		log.Printf("import: %s is missing", archiveChecks)
+		return ErrArchive
+	}
+	listed := 0
+	sc := bufio.NewScanner(bytes.NewReader(checks))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 2 {
+			log.Printf("import: invalid line in %s: %q", archiveChecks,
+				sc.Text())
+			return ErrArchive
+		}
+		if sums[fields[1]] != fields[0] {
+			log.Printf("import: checksum mismatch for %s", fields[1])
+			return ErrArchive
+		}
+		listed++
+	}
+	if err = sc.Err(); err != nil {
+		return err
+	}
+	if listed != len(sums) {
+		log.Printf("import: %d entries without a checksum",
+			len(sums)-listed)
+		return ErrArchive
+	}
+
+	return nil
+}
+
+// mediaName returns the name of the media file in an archive entry, or
+// "" if the entry is not a valid media file.
+func mediaName(entry string) string {
+	if !strings.HasPrefix(entry, archiveMedia) {
+		return ""
+	}
+	name := entry[len(archiveMedia):]
+	if name == "" || name != path.Base(name) || strings.HasPrefix(name, ".") {
+		return ""
+	}
+	return name
+}
+
+// cmdImport restores the archive named by args[0] to the Store selected
+// by -store and to the media directory. The archive is read once: the
+// media files are staged in a temporary directory while the checksums
+// are computed, and moved into place only once the whole archive is
+// verified. Records and files already present are overwritten, so the
+// same archive can be imported again safely.
+func cmdImport(args []string) error {
+	if len(args) != 1 {
+		return ErrUsage
+	}
+
+	s, err := newStore(*storeBackend)
+	if err != nil {
+		return err
+	}
+	if err = initSchema(s); err != nil {
+		return err
+	}
+	if err = checkSchema(s); err != nil {
+		return err
+	}
+
+	// The staging directory starts with a dot, like other temporary
+	// media files, and lives in the media directory so its files can be
+	// renamed into place.
+	staging, err := ioutil.TempDir(filepath.Join(mediaPath...), ".import-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	// Read the data and stage the media files, then check the archive.
+	var snap *Snapshot
+	media := []string{}
+	err = readArchive(args[0], func(h *tar.Header, r io.Reader) error {
+		switch name := mediaName(h.Name); {
+		case h.Name == archiveData:
+			snap = new(Snapshot)
+			return json.NewDecoder(r).Decode(snap)
+		case name != "" && h.Typeflag == tar.TypeReg:
+			media = append(media, name)
+			return stageMediaFile(filepath.Join(staging, name), r)
+		}
+		log.Printf("import: unexpected entry %s", h.Name)
+		return ErrArchive
+	})
+	if err != nil {
+		return err
+	}
+	if snap == nil {
+		log.Printf("import: %s is missing", archiveData)
+		return ErrArchive
+	}
+	if snap.Version != schemaVersion() {
+		log.Printf("import: the archive schema is at version %d, "+
+			"not %d", snap.Version, schemaVersion())
+		return ErrArchive
+	}
+
+	// Move the verified media files into place, then write the data, so
+	// posts never point at missing files.
+	for _, name := range media {
+		if err = commitMedia(filepath.Join(staging, name), name); err != nil {
+			return err
+		}
+	}
+	if err = s.Restore(context.Background(), snap); err != nil {
+		return err
+	}
+
+	log.Printf("import: %d users, %d posts and %d media files restored",
+		len(snap.Users), len(snap.Posts), len(media))
+	return nil
+}
+
+// stageMediaFile writes the content of r to the file at path and flushes
+// it to disk.
+func stageMediaFile(path string, r io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
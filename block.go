@@ -0,0 +1,85 @@
+/*
+Blocks and mutes between GoPics' users.
+
+Copyright (c) 2015, Luca Chiricozzi. All rights reserved.
+Released under the MIT License.
+http://opensource.org/licenses/MIT
+*/
+package main
+
+import "context"
+
+// Blocks holds the relations of a user that hide content: the users she
+// blocks or mutes and the users who block her, by folded name. Blocks
+// hide the posts and the comments of the two users from each other,
+// mutes only from the muter.
+type Blocks struct {
+	Blocking map[string]bool
+	Blockers map[string]bool
+	Muting   map[string]bool
+}
+
+// newBlocks creates new empty Blocks.
+func newBlocks() *Blocks {
+	return &Blocks{
+		Blocking: make(map[string]bool),
+		Blockers: make(map[string]bool),
+		Muting:   make(map[string]bool),
+	}
+}
+
+// blocked reports whether the user with the given name and the owner of
+// b block each other, either way.
+func (b *Blocks) blocked(username string) bool {
+	name := foldName(username)
+	return b.Blocking[name] || b.Blockers[name]
+}
+
+// hides reports whether the posts and the comments of the user with the
+// given name are hidden from the owner of b.
+func (b *Blocks) hides(username string) bool {
+	return b.blocked(username) || b.Muting[foldName(username)]
+}
+
+// viewerBlocks returns the Blocks of the logged user with the given
+// name, empty for anonymous users.
+func viewerBlocks(ctx context.Context, s Store,
+	logName string) (*Blocks, error) {
+	if logName == "" {
+		return newBlocks(), nil
+	}
+	return s.GetBlocks(ctx, logName)
+}
+
+// visiblePosts returns the posts whose author is not hidden by b.
+func visiblePosts(posts []Post, b *Blocks) []Post {
+	visible := []Post{}
+	for _, p := range posts {
+		if !b.hides(p.AuthorName) {
+			visible = append(visible, p)
+		}
+	}
+	return visible
+}
+
+// visibleNames returns the names of the users not hidden by b.
+func visibleNames(names []string, b *Blocks) []string {
+	visible := []string{}
+	for _, name := range names {
+		if !b.hides(name) {
+			visible = append(visible, name)
+		}
+	}
+	return visible
+}
+
+// visibleComments returns the comments whose author is not hidden by b.
+func visibleComments(cs []Comment, b *Blocks) []Comment {
+	visible := []Comment{}
+	for _, c := range cs {
+		if !b.hides(c.AuthorName) {
+			visible = append(visible, c)
+		}
+	}
+	return visible
+}
@@ -0,0 +1,152 @@
+/*
+Tests of the blocks and mutes of GoPics' users.
+
+Copyright (c) 2015, Luca Chiricozzi. All rights reserved.
+Released under the MIT License.
+http://opensource.org/licenses/MIT
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lucachr/gopics/auth"
+)
+
+// formRequest returns a POST request of the user with the given name to
+// path, with the given url-encoded form.
+func formRequest(username, path, form string) *http.Request {
+	w := httptest.NewRecorder()
+	auth.SetCookie(w, keyring, username)
+
+	r := httptest.NewRequest("POST", path, strings.NewReader(form))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Cookie", w.Header().Get("Set-Cookie"))
+	return r
+}
+
+// likeRequest returns a request of the user with the given name to like
+// or unlike the post with the given name.
+func likeRequest(username, name, like string) *http.Request {
+	return formRequest(username, "/like", "name="+name+"&like="+like)
+}
+
+// TestBlocksLikes checks that blocked users cannot like a post, and that
+// the likes and mentions of blocked and muted users are hidden.
+func TestBlocksLikes(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryStore()
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"Alice", "Bob", "Carol"} {
+		check(s.CreateUser(ctx, &User{Name: name, Email: name + "@x"}))
+	}
+	p := &Post{Name: "p.jpeg", AuthorName: "Alice", Time: 1}
+	check(s.AddPost(ctx, p))
+	for _, name := range []string{"Bob", "Carol"} {
+		_, err := s.LikePost(ctx, p, name, true, 2)
+		check(err)
+	}
+	check(s.AddMentions(ctx, p, []string{"Bob", "Carol"}, 2))
+	check(s.Block(ctx, "Alice", "Bob", true, 3))
+	check(s.Mute(ctx, "Alice", "Carol", true, 3))
+
+	for _, tt := range []struct {
+		viewer string
+		want   []string
+	}{
+		{"Alice", []string{}},
+		{"Carol", []string{"Bob", "Carol"}},
+		{"", []string{"Bob", "Carol"}},
+	} {
+		b, err := viewerBlocks(ctx, s, tt.viewer)
+		check(err)
+		posts, err := addPostDetails(ctx, s, []Post{*p}, tt.viewer, b)
+		check(err)
+		if len(posts) != 1 {
+			t.Fatalf("%q: got %d posts, want 1", tt.viewer, len(posts))
+		}
+		if !reflect.DeepEqual(posts[0].LikedBy, tt.want) {
+			t.Errorf("%q: got the likes of %v, want %v", tt.viewer,
+				posts[0].LikedBy, tt.want)
+		}
+		if !reflect.DeepEqual(posts[0].Mentioned, tt.want) {
+			t.Errorf("%q: got the mentions of %v, want %v", tt.viewer,
+				posts[0].Mentioned, tt.want)
+		}
+	}
+
+	ae := handleLike(httptest.NewRecorder(),
+		likeRequest("Bob", p.Name, "1"), s)
+	if ae == nil || ae.Err != ErrBlocked {
+		t.Fatalf("like of a blocked user: got %v, want ErrBlocked", ae)
+	}
+	ae = handleLike(httptest.NewRecorder(),
+		likeRequest("Bob", p.Name, "0"), s)
+	if ae != nil {
+		t.Fatalf("unlike of a blocked user: got %v", ae.Err)
+	}
+	likers, err := s.GetLikers(ctx, []string{p.Name})
+	check(err)
+	if got := likers[p.Name]; !reflect.DeepEqual(got, []string{"Carol"}) {
+		t.Errorf("got the likes of %v, want [Carol]", got)
+	}
+
+	// The count sent back leaves out the like of Carol, muted by Alice.
+	w := httptest.NewRecorder()
+	r := likeRequest("Alice", p.Name, "1")
+	r.Header.Set("X-Requested-With", "XMLHttpRequest")
+	if ae = handleLike(w, r, s); ae != nil {
+		t.Fatalf("like: got %v", ae.Err)
+	}
+	res := struct {
+		Likes int  `json:"likes"`
+		Liked bool `json:"liked"`
+	}{}
+	check(json.NewDecoder(w.Body).Decode(&res))
+	if res.Likes != 1 || !res.Liked {
+		t.Errorf("got %+v, want 1 like, liked", res)
+	}
+}
+
+// TestBlocksReplies checks that blocked users cannot reply to the
+// comments of each other, on the post of a third user.
+func TestBlocksReplies(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryStore()
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"Alice", "Bob", "Carol"} {
+		check(s.CreateUser(ctx, &User{Name: name, Email: name + "@x"}))
+	}
+	p := &Post{Name: "p.jpeg", AuthorName: "Alice", Time: 1}
+	check(s.AddPost(ctx, p))
+	check(s.AddComment(ctx, p, &Comment{ID: "c1", PostName: p.Name,
+		AuthorName: "Carol", Text: "hi", Time: 2}))
+	check(s.Block(ctx, "Carol", "Bob", true, 3))
+
+	ae := handleComment(httptest.NewRecorder(),
+		formRequest("Bob", "/comment", "name=p.jpeg&parent=c1&text=hi"), s)
+	if ae == nil || ae.Err != ErrBlocked {
+		t.Fatalf("reply of a blocked user: got %v, want ErrBlocked", ae)
+	}
+	ae = handleComment(httptest.NewRecorder(),
+		formRequest("Bob", "/comment", "name=p.jpeg&text=hi"), s)
+	if ae != nil {
+		t.Fatalf("comment of a blocked user: got %v", ae.Err)
+	}
+}
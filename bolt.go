@@ -0,0 +1,1344 @@
+/*
+Embedded on-disk Store for GoPics, built on bbolt.
+
+Copyright (c) 2015, Luca Chiricozzi. All rights reserved.
+Released under the MIT License.
+http://opensource.org/licenses/MIT
+*/
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const boltDefaultPath = "gopics.db"
+
+// Top level buckets of the bolt database. Users and timelines are keyed
+// by folded name, the emails bucket maps folded emails to folded names.
+// The timelines bucket holds a nested bucket for each user, the comments
+// bucket one for each post with comments, keyed by comment ID. The likes
+// bucket holds one for each liked post, keyed by folded name, the liked
+// bucket one for each user who likes something, keyed like timelines.
+// The mentions and mentioned buckets do the same for the mentions of
+// users. The tags bucket holds one for each folded hashtag, keyed like
+// timelines. The following bucket holds one for each user who follows
+// someone, keyed by the folded names of the followed users, the
+// followers bucket the other way around. The blocking and blockers
+// buckets do the same for blocks, the muting bucket holds one for each
+// user who mutes someone. The feeds bucket holds one for each user,
+// keyed like timelines, whose sequence counts its keys.
+var (
+	boltUsers     = []byte("users")
+	boltPosts     = []byte("posts")
+	boltComments  = []byte("comments")
+	boltLikes     = []byte("likes")
+	boltLiked     = []byte("liked")
+	boltMentions  = []byte("mentions")
+	boltMentioned = []byte("mentioned")
+	boltTags      = []byte("tags")
+	boltFollowing = []byte("following")
+	boltFollowers = []byte("followers")
+	boltBlocking  = []byte("blocking")
+	boltBlockers  = []byte("blockers")
+	boltMuting    = []byte("muting")
+	boltTimelines = []byte("timelines")
+	boltFeeds     = []byte("feeds")
+	boltEmails    = []byte("emails")
+	boltMeta      = []byte("meta")
+
+	boltSchemaKey = []byte("schema_version")
+)
+
+// boltStore is a Store that keeps its data in a single bolt database
+// file, so small installs do not need a Redis server.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// newBoltStore opens, or creates, the bolt database at path and returns
+// a Store on top of it.
+func newBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		buckets := [][]byte{boltUsers, boltEmails, boltPosts,
+			boltComments, boltLikes, boltLiked, boltMentions,
+			boltMentioned, boltTags, boltFollowing, boltFollowers,
+			boltBlocking, boltBlockers, boltMuting, boltTimelines,
+			boltFeeds, boltMeta}
+		for _, b := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+// boltScoreKey builds the key of a member in a timeline bucket. Keys
+// start with the big endian score, so a cursor walks them by score and,
+// for equal scores, by member name, like a Redis sorted set.
+func boltScoreKey(score int64, member string) []byte {
+	k := make([]byte, 8, 8+len(member))
+	binary.BigEndian.PutUint64(k, uint64(score))
+	return append(k, member...)
+}
+
+// boltScore returns the score in a key built by boltScoreKey.
+func boltScore(k []byte) int64 {
+	return int64(binary.BigEndian.Uint64(k[:8]))
+}
+
+// boltGetJSON decodes the JSON value of key in bucket b into v, it
+// returns ErrNotFound if the key does not exist.
+func boltGetJSON(b *bolt.Bucket, key string, v interface{}) error {
+	data := b.Get([]byte(key))
+	if data == nil {
+		return ErrNotFound
+	}
+	return json.Unmarshal(data, v)
+}
+
+// boltPutJSON stores v, encoded as JSON, under key in bucket b.
+func boltPutJSON(b *bolt.Bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+// boltAddToTimeline adds the post with the given name to the timeline of
+// username with the given score.
+func boltAddToTimeline(tx *bolt.Tx, username, name string, score int64) error {
+	tl, err := tx.Bucket(boltTimelines).CreateBucketIfNotExists(
+		[]byte(foldName(username)))
+	if err != nil {
+		return err
+	}
+	return tl.Put(boltScoreKey(score, name), nil)
+}
+
+// boltAddToFeed adds the post with the given name to the feed of the
+// user with the given folded name, with the given score, dropping the
+// oldest posts beyond feedLen.
+func boltAddToFeed(tx *bolt.Tx, username, name string, score int64) error {
+	feed, err := tx.Bucket(boltFeeds).CreateBucketIfNotExists(
+		[]byte(username))
+	if err != nil {
+		return err
+	}
+	k := boltScoreKey(score, name)
+	if feed.Get(k) != nil {
+		return nil
+	}
+	if err = feed.Put(k, nil); err != nil {
+		return err
+	}
+
+	n := feed.Sequence() + 1
+	c := feed.Cursor()
+	for ; n > feedLen; n-- {
+		if k, _ := c.First(); k == nil {
+			break
+		}
+		if err = c.Delete(); err != nil {
+			return err
+		}
+	}
+	return feed.SetSequence(n)
+}
+
+// boltRemoveFromFeed removes the post with the given name and score from
+// the feed of the user with the given folded name.
+func boltRemoveFromFeed(tx *bolt.Tx, username, name string,
+	score int64) error {
+	feed := tx.Bucket(boltFeeds).Bucket([]byte(username))
+	if feed == nil {
+		return nil
+	}
+	k := boltScoreKey(score, name)
+	if feed.Get(k) == nil {
+		return nil
+	}
+	if err := feed.Delete(k); err != nil {
+		return err
+	}
+	return feed.SetSequence(feed.Sequence() - 1)
+}
+
+// boltTag moves p from the pages of the hashtags of its stored version,
+// if any, to the pages of the given hashtags.
+func boltTag(tx *bolt.Tx, p *Post, tags []string) error {
+	root := tx.Bucket(boltTags)
+	old := Post{}
+	err := boltGetJSON(tx.Bucket(boltPosts), p.Name, &old)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	for _, tag := range old.Tags {
+		b := root.Bucket([]byte(tag))
+		if b == nil {
+			continue
+		}
+		if err = b.Delete(boltScoreKey(old.Time, old.Name)); err != nil {
+			return err
+		}
+	}
+
+	for _, tag := range tags {
+		b, err := root.CreateBucketIfNotExists([]byte(tag))
+		if err != nil {
+			return err
+		}
+		if err = b.Put(boltScoreKey(p.Time, p.Name), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boltPutUser stores a new user and its email in the index, unless the
+// folded name or email are taken.
+func boltPutUser(tx *bolt.Tx, usr *User) error {
+	name, email := []byte(foldName(usr.Name)), []byte(foldEmail(usr.Email))
+
+	users, emails := tx.Bucket(boltUsers), tx.Bucket(boltEmails)
+	if users.Get(name) != nil {
+		return ErrUserExists
+	}
+	if emails.Get(email) != nil {
+		return ErrEmailExists
+	}
+
+	if err := emails.Put(email, name); err != nil {
+		return err
+	}
+	return boltPutJSON(users, string(name), usr)
+}
+
+// GetUser implements Store.
+func (s *boltStore) GetUser(ctx context.Context, username string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	usr := new(User)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return boltGetJSON(tx.Bucket(boltUsers), foldName(username), usr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usr, nil
+}
+
+// GetUserByEmail implements Store.
+func (s *boltStore) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	usr := new(User)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		name := tx.Bucket(boltEmails).Get([]byte(foldEmail(email)))
+		if name == nil {
+			return ErrNotFound
+		}
+		return boltGetJSON(tx.Bucket(boltUsers), string(name), usr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usr, nil
+}
+
+// CreateUser implements Store.
+func (s *boltStore) CreateUser(ctx context.Context, usr *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPutUser(tx, usr)
+	})
+}
+
+// GetTimeline implements Store.
+func (s *boltStore) GetTimeline(ctx context.Context, username string, before int64,
+	n int) ([]Post, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	var posts []Post
+	var next int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		tl := tx.Bucket(boltTimelines).Bucket([]byte(foldName(username)))
+		var err error
+		posts, next, err = boltRevPage(tx, tl, before, n)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return posts, next, nil
+}
+
+// boltRevPage returns a page of the posts in the bucket b, keyed by
+// boltScoreKey, like Store.GetTimeline does. A nil bucket is empty.
+func boltRevPage(tx *bolt.Tx, b *bolt.Bucket, before int64,
+	n int) ([]Post, int64, error) {
+	posts := []Post{}
+	if b == nil {
+		return posts, 0, nil
+	}
+
+	// Move the cursor on the newest key before the cursor
+	c := b.Cursor()
+	var k []byte
+	if before > 0 {
+		k, _ = c.Seek(boltScoreKey(before, ""))
+	}
+	if k == nil {
+		k, _ = c.Last()
+	} else {
+		k, _ = c.Prev()
+	}
+
+	pb := tx.Bucket(boltPosts)
+	var last int64
+	for ; k != nil; k, _ = c.Prev() {
+		score := boltScore(k)
+		if len(posts) >= n && score != last {
+			return posts, last, nil
+		}
+		last = score
+
+		// A missing post is returned empty, as Redis does.
+		p := Post{}
+		err := boltGetJSON(pb, string(k[8:]), &p)
+		if err != nil && err != ErrNotFound {
+			return nil, 0, err
+		}
+		posts = append(posts, p)
+	}
+	return posts, 0, nil
+}
+
+// GetPost implements Store.
+func (s *boltStore) GetPost(ctx context.Context, name string) (*Post, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	p := new(Post)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return boltGetJSON(tx.Bucket(boltPosts), name, p)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// AddPost implements Store.
+func (s *boltStore) AddPost(ctx context.Context, p *Post) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := boltTag(tx, p, p.Tags); err != nil {
+			return err
+		}
+		if err := boltPutJSON(tx.Bucket(boltPosts), p.Name, p); err != nil {
+			return err
+		}
+		err := boltAddToTimeline(tx, p.AuthorName, p.Name, p.Time)
+		if err != nil {
+			return err
+		}
+
+		followers := tx.Bucket(boltFollowers).Bucket(
+			[]byte(foldName(p.AuthorName)))
+		if followers == nil {
+			return nil
+		}
+		return followers.ForEach(func(name, _ []byte) error {
+			return boltAddToFeed(tx, string(name), p.Name, p.Time)
+		})
+	})
+}
+
+// EditPost implements Store.
+func (s *boltStore) EditPost(ctx context.Context, p *Post, text string,
+	t int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		posts := tx.Bucket(boltPosts)
+		post := new(Post)
+		if err := boltGetJSON(posts, p.Name, post); err != nil {
+			return err
+		}
+		post.edit(text, t)
+		if err := boltTag(tx, post, post.Tags); err != nil {
+			return err
+		}
+		return boltPutJSON(posts, p.Name, post)
+	})
+}
+
+// DeletePost implements Store.
+func (s *boltStore) DeletePost(ctx context.Context, p *Post) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := boltTag(tx, p, nil); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltPosts).Delete([]byte(p.Name)); err != nil {
+			return err
+		}
+		err := tx.Bucket(boltComments).DeleteBucket([]byte(p.Name))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		likes, err := boltGetLikes(tx, p.Name)
+		if err != nil {
+			return err
+		}
+		for _, l := range likes {
+			if err = boltLike(tx, l, false); err != nil {
+				return err
+			}
+		}
+		err = tx.Bucket(boltLikes).DeleteBucket([]byte(p.Name))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		mentions, err := boltGetMentions(tx, p.Name)
+		if err != nil {
+			return err
+		}
+		for _, m := range mentions {
+			b := tx.Bucket(boltMentioned).Bucket([]byte(foldName(m.UserName)))
+			if b == nil {
+				continue
+			}
+			if err = b.Delete(boltScoreKey(m.Time, p.Name)); err != nil {
+				return err
+			}
+		}
+		err = tx.Bucket(boltMentions).DeleteBucket([]byte(p.Name))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+
+		author := []byte(foldName(p.AuthorName))
+		followers := tx.Bucket(boltFollowers).Bucket(author)
+		if followers != nil {
+			err = followers.ForEach(func(name, _ []byte) error {
+				return boltRemoveFromFeed(tx, string(name), p.Name, p.Time)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		tl := tx.Bucket(boltTimelines).Bucket(author)
+		if tl == nil {
+			return nil
+		}
+		return tl.Delete(boltScoreKey(p.Time, p.Name))
+	})
+}
+
+// GetComments implements Store.
+func (s *boltStore) GetComments(ctx context.Context,
+	names []string) (map[string][]Comment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	comments := make(map[string][]Comment)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, name := range names {
+			cs, err := boltGetComments(tx, name)
+			if err != nil {
+				return err
+			}
+			comments[name] = cs
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+// boltGetComments returns the comments on the post with the given name.
+func boltGetComments(tx *bolt.Tx, name string) ([]Comment, error) {
+	cs := []Comment{}
+	b := tx.Bucket(boltComments).Bucket([]byte(name))
+	if b == nil {
+		return cs, nil
+	}
+	err := b.ForEach(func(_, v []byte) error {
+		c := Comment{}
+		if err := json.Unmarshal(v, &c); err != nil {
+			return err
+		}
+		cs = append(cs, c)
+		return nil
+	})
+	return cs, err
+}
+
+// AddComment implements Store.
+func (s *boltStore) AddComment(ctx context.Context, p *Post,
+	c *Comment) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		post := new(Post)
+		if err := boltGetJSON(tx.Bucket(boltPosts), p.Name, post); err != nil {
+			return err
+		}
+		if post.NoComments {
+			return ErrCommentsOff
+		}
+
+		b, err := tx.Bucket(boltComments).CreateBucketIfNotExists(
+			[]byte(p.Name))
+		if err != nil {
+			return err
+		}
+		if c.Parent != "" && b.Get([]byte(c.Parent)) == nil {
+			return ErrNotFound
+		}
+		return boltPutJSON(b, c.ID, c)
+	})
+}
+
+// DeleteComments implements Store.
+func (s *boltStore) DeleteComments(ctx context.Context, p *Post,
+	ids []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltComments).Bucket([]byte(p.Name))
+		if b == nil {
+			return nil
+		}
+		for _, id := range ids {
+			if err := b.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SetCommentsOff implements Store.
+func (s *boltStore) SetCommentsOff(ctx context.Context, p *Post,
+	off bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		posts := tx.Bucket(boltPosts)
+		post := new(Post)
+		if err := boltGetJSON(posts, p.Name, post); err != nil {
+			return err
+		}
+		post.NoComments = off
+		return boltPutJSON(posts, p.Name, post)
+	})
+}
+
+// LikePost implements Store.
+func (s *boltStore) LikePost(ctx context.Context, p *Post, username string,
+	like bool, t int64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	var n int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltPosts).Get([]byte(p.Name)) == nil {
+			return ErrNotFound
+		}
+		if err := boltLike(tx, Like{p.Name, username, t}, like); err != nil {
+			return err
+		}
+		likes, err := boltGetLikes(tx, p.Name)
+		n = len(likes)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// boltLike adds or removes l.
+func boltLike(tx *bolt.Tx, l Like, like bool) error {
+	name := []byte(foldName(l.UserName))
+	if !like {
+		return boltUnlike(tx, l.PostName, name)
+	}
+
+	likes, err := tx.Bucket(boltLikes).CreateBucketIfNotExists(
+		[]byte(l.PostName))
+	if err != nil {
+		return err
+	}
+	if likes.Get(name) != nil {
+		return nil
+	}
+	liked, err := tx.Bucket(boltLiked).CreateBucketIfNotExists(name)
+	if err != nil {
+		return err
+	}
+
+	if err = boltPutJSON(likes, string(name), l); err != nil {
+		return err
+	}
+	return liked.Put(boltScoreKey(l.Time, l.PostName), nil)
+}
+
+// boltUnlike removes the like of the user with the given folded name
+// for the post with the given name, if any.
+func boltUnlike(tx *bolt.Tx, post string, name []byte) error {
+	likes := tx.Bucket(boltLikes).Bucket([]byte(post))
+	if likes == nil {
+		return nil
+	}
+	l := Like{}
+	err := boltGetJSON(likes, string(name), &l)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = likes.Delete(name); err != nil {
+		return err
+	}
+	liked := tx.Bucket(boltLiked).Bucket(name)
+	if liked == nil {
+		return nil
+	}
+	return liked.Delete(boltScoreKey(l.Time, post))
+}
+
+// boltGetLikes returns the likes of the post with the given name.
+func boltGetLikes(tx *bolt.Tx, name string) ([]Like, error) {
+	likes := []Like{}
+	b := tx.Bucket(boltLikes).Bucket([]byte(name))
+	if b == nil {
+		return likes, nil
+	}
+	err := b.ForEach(func(_, v []byte) error {
+		l := Like{}
+		if err := json.Unmarshal(v, &l); err != nil {
+			return err
+		}
+		likes = append(likes, l)
+		return nil
+	})
+	return likes, err
+}
+
+// GetLikers implements Store.
+func (s *boltStore) GetLikers(ctx context.Context,
+	names []string) (map[string][]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	likers := make(map[string][]string)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, name := range names {
+			likes, err := boltGetLikes(tx, name)
+			if err != nil {
+				return err
+			}
+			users := []string{}
+			for _, l := range likes {
+				users = append(users, l.UserName)
+			}
+			sort.Strings(users)
+			likers[name] = users
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return likers, nil
+}
+
+// GetLikedPosts implements Store.
+func (s *boltStore) GetLikedPosts(ctx context.Context, username string,
+	before int64, n int) ([]Post, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	var posts []Post
+	var next int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		liked := tx.Bucket(boltLiked).Bucket([]byte(foldName(username)))
+		var err error
+		posts, next, err = boltRevPage(tx, liked, before, n)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return existingPosts(posts), next, nil
+}
+
+// AddMentions implements Store.
+func (s *boltStore) AddMentions(ctx context.Context, p *Post,
+	usernames []string, t int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltPosts).Get([]byte(p.Name)) == nil {
+			return ErrNotFound
+		}
+		for _, name := range usernames {
+			if err := boltMention(tx, Mention{p.Name, name, t}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// boltMention adds m, unless the user is already mentioned in the post.
+func boltMention(tx *bolt.Tx, m Mention) error {
+	name := []byte(foldName(m.UserName))
+	mentions, err := tx.Bucket(boltMentions).CreateBucketIfNotExists(
+		[]byte(m.PostName))
+	if err != nil {
+		return err
+	}
+	if mentions.Get(name) != nil {
+		return nil
+	}
+	mentioned, err := tx.Bucket(boltMentioned).CreateBucketIfNotExists(name)
+	if err != nil {
+		return err
+	}
+
+	if err = boltPutJSON(mentions, string(name), m); err != nil {
+		return err
+	}
+	return mentioned.Put(boltScoreKey(m.Time, m.PostName), nil)
+}
+
+// boltGetMentions returns the mentions in the post with the given name.
+func boltGetMentions(tx *bolt.Tx, name string) ([]Mention, error) {
+	mentions := []Mention{}
+	b := tx.Bucket(boltMentions).Bucket([]byte(name))
+	if b == nil {
+		return mentions, nil
+	}
+	err := b.ForEach(func(_, v []byte) error {
+		m := Mention{}
+		if err := json.Unmarshal(v, &m); err != nil {
+			return err
+		}
+		mentions = append(mentions, m)
+		return nil
+	})
+	return mentions, err
+}
+
+// GetMentioned implements Store.
+func (s *boltStore) GetMentioned(ctx context.Context,
+	names []string) (map[string][]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mentioned := make(map[string][]string)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, name := range names {
+			mentions, err := boltGetMentions(tx, name)
+			if err != nil {
+				return err
+			}
+			users := []string{}
+			for _, m := range mentions {
+				users = append(users, m.UserName)
+			}
+			sort.Strings(users)
+			mentioned[name] = users
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mentioned, nil
+}
+
+// GetMentionPosts implements Store.
+func (s *boltStore) GetMentionPosts(ctx context.Context, username string,
+	before int64, n int) ([]Post, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	var posts []Post
+	var next int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltMentioned).Bucket([]byte(foldName(username)))
+		var err error
+		posts, next, err = boltRevPage(tx, b, before, n)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return existingPosts(posts), next, nil
+}
+
+// Follow implements Store.
+func (s *boltStore) Follow(ctx context.Context, username, other string,
+	follow bool, t int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f := Follow{foldName(username), foldName(other), t}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltUsers).Get([]byte(f.Followed)) == nil {
+			return ErrNotFound
+		}
+		if follow && (boltHasRelation(tx, boltBlocking, f.Follower,
+			f.Followed) || boltHasRelation(tx, boltBlocking, f.Followed,
+			f.Follower)) {
+			return ErrBlocked
+		}
+		followed := boltHasRelation(tx, boltFollowing, f.Follower,
+			f.Followed)
+
+		switch {
+		case follow && !followed:
+			if err := boltFollow(tx, f); err != nil {
+				return err
+			}
+			tl := tx.Bucket(boltTimelines).Bucket([]byte(f.Followed))
+			if tl == nil {
+				return nil
+			}
+			c := tl.Cursor()
+			k, _ := c.Last()
+			for i := 0; k != nil && i < feedBackfill; i++ {
+				err := boltAddToFeed(tx, f.Follower, string(k[8:]),
+					boltScore(k))
+				if err != nil {
+					return err
+				}
+				k, _ = c.Prev()
+			}
+		case !follow && followed:
+			return boltUnfollow(tx, f.Follower, f.Followed)
+		}
+		return nil
+	})
+}
+
+// boltUnfollow removes the follow of followed by follower, both folded,
+// and the posts of followed from the feed of follower.
+func boltUnfollow(tx *bolt.Tx, follower, followed string) error {
+	if !boltHasRelation(tx, boltFollowing, follower, followed) {
+		return nil
+	}
+	err := tx.Bucket(boltFollowing).Bucket([]byte(follower)).Delete(
+		[]byte(followed))
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(boltFollowers).Bucket([]byte(followed)).Delete(
+		[]byte(follower))
+	tl := tx.Bucket(boltTimelines).Bucket([]byte(followed))
+	if err != nil || tl == nil {
+		return err
+	}
+	return tl.ForEach(func(k, _ []byte) error {
+		return boltRemoveFromFeed(tx, follower, string(k[8:]), boltScore(k))
+	})
+}
+
+// boltHasRelation reports whether the nested bucket of root named from
+// holds the key to.
+func boltHasRelation(tx *bolt.Tx, root []byte, from, to string) bool {
+	b := tx.Bucket(root).Bucket([]byte(from))
+	return b != nil && b.Get([]byte(to)) != nil
+}
+
+// boltDeleteRelation deletes the key to from the nested bucket of root
+// named from, if any.
+func boltDeleteRelation(tx *bolt.Tx, root []byte, from, to string) error {
+	b := tx.Bucket(root).Bucket([]byte(from))
+	if b == nil {
+		return nil
+	}
+	return b.Delete([]byte(to))
+}
+
+// boltFollow adds f to the follow graph.
+func boltFollow(tx *bolt.Tx, f Follow) error {
+	following, err := tx.Bucket(boltFollowing).CreateBucketIfNotExists(
+		[]byte(f.Follower))
+	if err != nil {
+		return err
+	}
+	followers, err := tx.Bucket(boltFollowers).CreateBucketIfNotExists(
+		[]byte(f.Followed))
+	if err != nil {
+		return err
+	}
+	if err = boltPutJSON(following, f.Followed, f); err != nil {
+		return err
+	}
+	return followers.Put([]byte(f.Follower), nil)
+}
+
+// IsFollowing implements Store.
+func (s *boltStore) IsFollowing(ctx context.Context, username,
+	other string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	var followed bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		followed = boltHasRelation(tx, boltFollowing, foldName(username),
+			foldName(other))
+		return nil
+	})
+	return followed, err
+}
+
+// GetFollowCounts implements Store.
+func (s *boltStore) GetFollowCounts(ctx context.Context,
+	username string) (int, int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+	name := []byte(foldName(username))
+	var followers, following int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(boltFollowers).Bucket(name); b != nil {
+			followers = b.Stats().KeyN
+		}
+		if b := tx.Bucket(boltFollowing).Bucket(name); b != nil {
+			following = b.Stats().KeyN
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return followers, following, nil
+}
+
+// GetFeed implements Store.
+func (s *boltStore) GetFeed(ctx context.Context, username string,
+	before int64, n int) ([]Post, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	var posts []Post
+	var next int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		feed := tx.Bucket(boltFeeds).Bucket([]byte(foldName(username)))
+		var err error
+		posts, next, err = boltRevPage(tx, feed, before, n)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return existingPosts(posts), next, nil
+}
+
+// Block implements Store.
+func (s *boltStore) Block(ctx context.Context, username, other string,
+	block bool, t int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r := Relation{foldName(username), foldName(other), t}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltUsers).Get([]byte(r.To)) == nil {
+			return ErrNotFound
+		}
+		if !block {
+			err := boltDeleteRelation(tx, boltBlocking, r.From, r.To)
+			if err != nil {
+				return err
+			}
+			return boltDeleteRelation(tx, boltBlockers, r.To, r.From)
+		}
+		if !boltHasRelation(tx, boltBlocking, r.From, r.To) {
+			if err := boltBlock(tx, r); err != nil {
+				return err
+			}
+		}
+		if err := boltUnfollow(tx, r.From, r.To); err != nil {
+			return err
+		}
+		return boltUnfollow(tx, r.To, r.From)
+	})
+}
+
+// boltBlock adds the block r.
+func boltBlock(tx *bolt.Tx, r Relation) error {
+	blocking, err := tx.Bucket(boltBlocking).CreateBucketIfNotExists(
+		[]byte(r.From))
+	if err != nil {
+		return err
+	}
+	blockers, err := tx.Bucket(boltBlockers).CreateBucketIfNotExists(
+		[]byte(r.To))
+	if err != nil {
+		return err
+	}
+	if err = boltPutJSON(blocking, r.To, r); err != nil {
+		return err
+	}
+	return blockers.Put([]byte(r.From), nil)
+}
+
+// Mute implements Store.
+func (s *boltStore) Mute(ctx context.Context, username, other string,
+	mute bool, t int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r := Relation{foldName(username), foldName(other), t}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltUsers).Get([]byte(r.To)) == nil {
+			return ErrNotFound
+		}
+		if !mute {
+			return boltDeleteRelation(tx, boltMuting, r.From, r.To)
+		}
+		if boltHasRelation(tx, boltMuting, r.From, r.To) {
+			return nil
+		}
+		return boltMute(tx, r)
+	})
+}
+
+// boltMute adds the mute r.
+func boltMute(tx *bolt.Tx, r Relation) error {
+	muting, err := tx.Bucket(boltMuting).CreateBucketIfNotExists(
+		[]byte(r.From))
+	if err != nil {
+		return err
+	}
+	return boltPutJSON(muting, r.To, r)
+}
+
+// GetBlocks implements Store.
+func (s *boltStore) GetBlocks(ctx context.Context,
+	username string) (*Blocks, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	name := []byte(foldName(username))
+	b := newBlocks()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		sets := map[string]map[string]bool{
+			string(boltBlocking): b.Blocking,
+			string(boltBlockers): b.Blockers,
+			string(boltMuting):   b.Muting,
+		}
+		for root, set := range sets {
+			nested := tx.Bucket([]byte(root)).Bucket(name)
+			if nested == nil {
+				continue
+			}
+			err := nested.ForEach(func(k, _ []byte) error {
+				set[string(k)] = true
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// GetTagPosts implements Store.
+func (s *boltStore) GetTagPosts(ctx context.Context, tag string,
+	before int64, n int) ([]Post, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	var posts []Post
+	var next int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltTags).Bucket([]byte(tag))
+		var err error
+		posts, next, err = boltRevPage(tx, b, before, n)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return existingPosts(posts), next, nil
+}
+
+// Snapshot implements Store.
+func (s *boltStore) Snapshot(ctx context.Context) (*Snapshot, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	snap := &Snapshot{
+		Users:     []User{},
+		Posts:     []Post{},
+		Comments:  []Comment{},
+		Likes:     []Like{},
+		Mentions:  []Mention{},
+		Follows:   []Follow{},
+		Timelines: make(map[string][]scoredMember),
+		Feeds:     make(map[string][]scoredMember),
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(boltUsers).ForEach(func(k, v []byte) error {
+			usr := User{}
+			if err := json.Unmarshal(v, &usr); err != nil {
+				return err
+			}
+			snap.Users = append(snap.Users, usr)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(boltPosts).ForEach(func(k, v []byte) error {
+			p := Post{}
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			snap.Posts = append(snap.Posts, p)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(boltComments).ForEach(func(name, _ []byte) error {
+			cs, err := boltGetComments(tx, string(name))
+			snap.Comments = append(snap.Comments, cs...)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(boltLikes).ForEach(func(name, _ []byte) error {
+			likes, err := boltGetLikes(tx, string(name))
+			snap.Likes = append(snap.Likes, likes...)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(boltMentions).ForEach(func(name, _ []byte) error {
+			mentions, err := boltGetMentions(tx, string(name))
+			snap.Mentions = append(snap.Mentions, mentions...)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		following := tx.Bucket(boltFollowing)
+		err = following.ForEach(func(name, _ []byte) error {
+			return following.Bucket(name).ForEach(func(_, v []byte) error {
+				f := Follow{}
+				if err := json.Unmarshal(v, &f); err != nil {
+					return err
+				}
+				snap.Follows = append(snap.Follows, f)
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		snap.Blocks, err = boltSnapshotRelations(tx.Bucket(boltBlocking))
+		if err != nil {
+			return err
+		}
+		snap.Mutes, err = boltSnapshotRelations(tx.Bucket(boltMuting))
+		if err != nil {
+			return err
+		}
+
+		err = boltSnapshotSets(tx.Bucket(boltTimelines), snap.Timelines)
+		if err != nil {
+			return err
+		}
+		return boltSnapshotSets(tx.Bucket(boltFeeds), snap.Feeds)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	snap.Version, err = s.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// boltSnapshotSets copies the nested buckets of b, keyed by boltScoreKey,
+// into sets, by bucket name.
+func boltSnapshotSets(b *bolt.Bucket, sets map[string][]scoredMember) error {
+	return b.ForEach(func(name, _ []byte) error {
+		members := []scoredMember{}
+		err := b.Bucket(name).ForEach(func(k, _ []byte) error {
+			members = append(members,
+				scoredMember{boltScore(k), string(k[8:])})
+			return nil
+		})
+		sets[string(name)] = members
+		return err
+	})
+}
+
+// boltSnapshotRelations returns the relations held in the nested buckets
+// of b, like blocking.
+func boltSnapshotRelations(b *bolt.Bucket) ([]Relation, error) {
+	relations := []Relation{}
+	err := b.ForEach(func(name, _ []byte) error {
+		return b.Bucket(name).ForEach(func(_, v []byte) error {
+			r := Relation{}
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			relations = append(relations, r)
+			return nil
+		})
+	})
+	return relations, err
+}
+
+// Restore implements Store.
+func (s *boltStore) Restore(ctx context.Context, snap *Snapshot) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, usr := range snap.Users {
+			name := foldName(usr.Name)
+			err := tx.Bucket(boltEmails).Put([]byte(foldEmail(usr.Email)),
+				[]byte(name))
+			if err != nil {
+				return err
+			}
+			if err = boltPutJSON(tx.Bucket(boltUsers), name, usr); err != nil {
+				return err
+			}
+		}
+
+		for _, p := range snap.Posts {
+			if err := boltTag(tx, &p, p.Tags); err != nil {
+				return err
+			}
+			if err := boltPutJSON(tx.Bucket(boltPosts), p.Name, p); err != nil {
+				return err
+			}
+		}
+
+		for _, c := range snap.Comments {
+			b, err := tx.Bucket(boltComments).CreateBucketIfNotExists(
+				[]byte(c.PostName))
+			if err != nil {
+				return err
+			}
+			if err = boltPutJSON(b, c.ID, c); err != nil {
+				return err
+			}
+		}
+
+		for _, l := range snap.Likes {
+			if err := boltLike(tx, l, true); err != nil {
+				return err
+			}
+		}
+
+		for _, m := range snap.Mentions {
+			if err := boltMention(tx, m); err != nil {
+				return err
+			}
+		}
+
+		for _, f := range snap.Follows {
+			if err := boltFollow(tx, f); err != nil {
+				return err
+			}
+		}
+
+		for _, r := range snap.Blocks {
+			if err := boltBlock(tx, r); err != nil {
+				return err
+			}
+		}
+
+		for _, r := range snap.Mutes {
+			if err := boltMute(tx, r); err != nil {
+				return err
+			}
+		}
+
+		for name, members := range snap.Timelines {
+			for _, m := range members {
+				err := boltAddToTimeline(tx, name, m.Member, m.Score)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		for name, members := range snap.Feeds {
+			for _, m := range members {
+				err := boltAddToFeed(tx, name, m.Member, m.Score)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,403 @@
+/*
+Circuit breaker for the GoPics' Store.
+
+Copyright (c) 2015, Luca Chiricozzi. All rights reserved.
+Released under the MIT License.
+http://opensource.org/licenses/MIT
+*/
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// Consecutive backend failures that open the breaker.
+	breakerThreshold = 5
+
+	// Time the breaker stays open before letting a request try the
+	// backend again.
+	breakerCooldown = 10 * time.Second
+)
+
+// A breaker stops the requests to an unhealthy backend. It opens after
+// threshold consecutive failures, then, once cooldown has passed, it
+// lets a single trial request through: if the trial succeeds the breaker
+// closes, otherwise it stays open for another cooldown.
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int       // Consecutive failures
+	openedAt  time.Time // Time of the last failure while open
+	trial     bool      // A trial request is running
+}
+
+// newBreaker creates a new closed breaker.
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// isOpen reports whether the requests to the backend are stopped.
+func (b *breaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.failures >= b.threshold &&
+		(b.trial || time.Since(b.openedAt) < b.cooldown)
+}
+
+// allow reports whether a request can go to the backend, if it can, the
+// result of the request must be passed to done.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case b.failures < b.threshold:
+		return true
+	case b.trial || time.Since(b.openedAt) < b.cooldown:
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// done records the error returned by a request to the backend. Only
+// the errors of an unavailable backend count as failures, a canceled
+// request counts as nothing.
+func (b *breaker) done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+	switch {
+	case err == context.Canceled:
+	case !unavailable(err):
+		if b.failures >= b.threshold {
+			log.Println("breaker: the store is back, closing")
+		}
+		b.failures = 0
+	default:
+		b.failures++
+		if b.failures == b.threshold {
+			log.Println("breaker: the store is failing, opening:", err)
+		}
+		if b.failures >= b.threshold {
+			b.openedAt = time.Now()
+		}
+	}
+}
+
+// breakerStore is a Store that stops calling its backend while the
+// breaker is open, returning ErrUnavailable instead.
+type breakerStore struct {
+	Store
+	b *breaker
+}
+
+// GetUser implements Store.
+func (s breakerStore) GetUser(ctx context.Context,
+	username string) (*User, error) {
+	if !s.b.allow() {
+		return nil, ErrUnavailable
+	}
+	usr, err := s.Store.GetUser(ctx, username)
+	s.b.done(err)
+	return usr, err
+}
+
+// GetUserByEmail implements Store.
+func (s breakerStore) GetUserByEmail(ctx context.Context,
+	email string) (*User, error) {
+	if !s.b.allow() {
+		return nil, ErrUnavailable
+	}
+	usr, err := s.Store.GetUserByEmail(ctx, email)
+	s.b.done(err)
+	return usr, err
+}
+
+// CreateUser implements Store.
+func (s breakerStore) CreateUser(ctx context.Context, usr *User) error {
+	if !s.b.allow() {
+		return ErrUnavailable
+	}
+	err := s.Store.CreateUser(ctx, usr)
+	s.b.done(err)
+	return err
+}
+
+// GetTimeline implements Store.
+func (s breakerStore) GetTimeline(ctx context.Context, username string,
+	before int64, n int) ([]Post, int64, error) {
+	if !s.b.allow() {
+		return nil, 0, ErrUnavailable
+	}
+	posts, next, err := s.Store.GetTimeline(ctx, username, before, n)
+	s.b.done(err)
+	return posts, next, err
+}
+
+// GetPost implements Store.
+func (s breakerStore) GetPost(ctx context.Context,
+	name string) (*Post, error) {
+	if !s.b.allow() {
+		return nil, ErrUnavailable
+	}
+	p, err := s.Store.GetPost(ctx, name)
+	s.b.done(err)
+	return p, err
+}
+
+// AddPost implements Store.
+func (s breakerStore) AddPost(ctx context.Context, p *Post) error {
+	if !s.b.allow() {
+		return ErrUnavailable
+	}
+	err := s.Store.AddPost(ctx, p)
+	s.b.done(err)
+	return err
+}
+
+// EditPost implements Store.
+func (s breakerStore) EditPost(ctx context.Context, p *Post, text string,
+	t int64) error {
+	if !s.b.allow() {
+		return ErrUnavailable
+	}
+	err := s.Store.EditPost(ctx, p, text, t)
+	s.b.done(err)
+	return err
+}
+
+// DeletePost implements Store.
+func (s breakerStore) DeletePost(ctx context.Context, p *Post) error {
+	if !s.b.allow() {
+		return ErrUnavailable
+	}
+	err := s.Store.DeletePost(ctx, p)
+	s.b.done(err)
+	return err
+}
+
+// GetComments implements Store.
+func (s breakerStore) GetComments(ctx context.Context,
+	names []string) (map[string][]Comment, error) {
+	if !s.b.allow() {
+		return nil, ErrUnavailable
+	}
+	comments, err := s.Store.GetComments(ctx, names)
+	s.b.done(err)
+	return comments, err
+}
+
+// AddComment implements Store.
+func (s breakerStore) AddComment(ctx context.Context, p *Post,
+	c *Comment) error {
+	if !s.b.allow() {
+		return ErrUnavailable
+	}
+	err := s.Store.AddComment(ctx, p, c)
+	s.b.done(err)
+	return err
+}
+
+// DeleteComments implements Store.
+func (s breakerStore) DeleteComments(ctx context.Context, p *Post,
+	ids []string) error {
+	if !s.b.allow() {
+		return ErrUnavailable
+	}
+	err := s.Store.DeleteComments(ctx, p, ids)
+	s.b.done(err)
+	return err
+}
+
+// SetCommentsOff implements Store.
+func (s breakerStore) SetCommentsOff(ctx context.Context, p *Post,
+	off bool) error {
+	if !s.b.allow() {
+		return ErrUnavailable
+	}
+	err := s.Store.SetCommentsOff(ctx, p, off)
+	s.b.done(err)
+	return err
+}
+
+// LikePost implements Store.
+func (s breakerStore) LikePost(ctx context.Context, p *Post,
+	username string, like bool, t int64) (int, error) {
+	if !s.b.allow() {
+		return 0, ErrUnavailable
+	}
+	n, err := s.Store.LikePost(ctx, p, username, like, t)
+	s.b.done(err)
+	return n, err
+}
+
+// GetLikers implements Store.
+func (s breakerStore) GetLikers(ctx context.Context,
+	names []string) (map[string][]string, error) {
+	if !s.b.allow() {
+		return nil, ErrUnavailable
+	}
+	likers, err := s.Store.GetLikers(ctx, names)
+	s.b.done(err)
+	return likers, err
+}
+
+// GetLikedPosts implements Store.
+func (s breakerStore) GetLikedPosts(ctx context.Context, username string,
+	before int64, n int) ([]Post, int64, error) {
+	if !s.b.allow() {
+		return nil, 0, ErrUnavailable
+	}
+	posts, next, err := s.Store.GetLikedPosts(ctx, username, before, n)
+	s.b.done(err)
+	return posts, next, err
+}
+
+// AddMentions implements Store.
+func (s breakerStore) AddMentions(ctx context.Context, p *Post,
+	usernames []string, t int64) error {
+	if !s.b.allow() {
+		return ErrUnavailable
+	}
+	err := s.Store.AddMentions(ctx, p, usernames, t)
+	s.b.done(err)
+	return err
+}
+
+// GetMentioned implements Store.
+func (s breakerStore) GetMentioned(ctx context.Context,
+	names []string) (map[string][]string, error) {
+	if !s.b.allow() {
+		return nil, ErrUnavailable
+	}
+	mentioned, err := s.Store.GetMentioned(ctx, names)
+	s.b.done(err)
+	return mentioned, err
+}
+
+// GetMentionPosts implements Store.
+func (s breakerStore) GetMentionPosts(ctx context.Context, username string,
+	before int64, n int) ([]Post, int64, error) {
+	if !s.b.allow() {
+		return nil, 0, ErrUnavailable
+	}
+	posts, next, err := s.Store.GetMentionPosts(ctx, username, before, n)
+	s.b.done(err)
+	return posts, next, err
+}
+
+// Follow implements Store.
+func (s breakerStore) Follow(ctx context.Context, username, other string,
+	follow bool, t int64) error {
+	if !s.b.allow() {
+		return ErrUnavailable
+	}
+	err := s.Store.Follow(ctx, username, other, follow, t)
+	s.b.done(err)
+	return err
+}
+
+// IsFollowing implements Store.
+func (s breakerStore) IsFollowing(ctx context.Context, username,
+	other string) (bool, error) {
+	if !s.b.allow() {
+		return false, ErrUnavailable
+	}
+	followed, err := s.Store.IsFollowing(ctx, username, other)
+	s.b.done(err)
+	return followed, err
+}
+
+// GetFollowCounts implements Store.
+func (s breakerStore) GetFollowCounts(ctx context.Context,
+	username string) (int, int, error) {
+	if !s.b.allow() {
+		return 0, 0, ErrUnavailable
+	}
+	followers, following, err := s.Store.GetFollowCounts(ctx, username)
+	s.b.done(err)
+	return followers, following, err
+}
+
+// GetFeed implements Store.
+func (s breakerStore) GetFeed(ctx context.Context, username string,
+	before int64, n int) ([]Post, int64, error) {
+	if !s.b.allow() {
+		return nil, 0, ErrUnavailable
+	}
+	posts, next, err := s.Store.GetFeed(ctx, username, before, n)
+	s.b.done(err)
+	return posts, next, err
+}
+
+// Block implements Store.
+func (s breakerStore) Block(ctx context.Context, username, other string,
+	block bool, t int64) error {
+	if !s.b.allow() {
+		return ErrUnavailable
+	}
+	err := s.Store.Block(ctx, username, other, block, t)
+	s.b.done(err)
+	return err
+}
+
+// Mute implements Store.
+func (s breakerStore) Mute(ctx context.Context, username, other string,
+	mute bool, t int64) error {
+	if !s.b.allow() {
+		return ErrUnavailable
+	}
+	err := s.Store.Mute(ctx, username, other, mute, t)
+	s.b.done(err)
+	return err
+}
+
+// GetBlocks implements Store.
+func (s breakerStore) GetBlocks(ctx context.Context,
+	username string) (*Blocks, error) {
+	if !s.b.allow() {
+		return nil, ErrUnavailable
+	}
+	b, err := s.Store.GetBlocks(ctx, username)
+	s.b.done(err)
+	return b, err
+}
+
+// GetTagPosts implements Store.
+func (s breakerStore) GetTagPosts(ctx context.Context, tag string,
+	before int64, n int) ([]Post, int64, error) {
+	if !s.b.allow() {
+		return nil, 0, ErrUnavailable
+	}
+	posts, next, err := s.Store.GetTagPosts(ctx, tag, before, n)
+	s.b.done(err)
+	return posts, next, err
+}
+
+// Snapshot implements Store.
+func (s breakerStore) Snapshot(ctx context.Context) (*Snapshot, error) {
+	if !s.b.allow() {
+		return nil, ErrUnavailable
+	}
+	snap, err := s.Store.Snapshot(ctx)
+	s.b.done(err)
+	return snap, err
+}
+
+// Restore implements Store.
+func (s breakerStore) Restore(ctx context.Context, snap *Snapshot) error {
+	if !s.b.allow() {
+		return ErrUnavailable
+	}
+	err := s.Store.Restore(ctx, snap)
+	s.b.done(err)
+	return err
+}
@@ -0,0 +1,221 @@
+/*
+Cache of rendered timelines for GoPics.
+
+Copyright (c) 2015, Luca Chiricozzi. All rights reserved.
+Released under the MIT License.
+http://opensource.org/licenses/MIT
+*/
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+)
+
+// Max number of pages in the timeline cache.
+const pageCacheMax = 1000
+
+// A viewer is the kind of user looking at a timeline. Only the pages
+// seen by anonymous users and by the owner of the timeline are the same
+// for every request, so only those are cached.
+type viewer int
+
+const (
+	anonymous viewer = iota
+	owner
+)
+
+// A renderedPage is the body of a rendered page, with its ETag.
+type renderedPage struct {
+	Body []byte
+	ETag string
+}
+
+// pageCache keeps the rendered first page of the timelines, by user and
+// viewer. The pages of a user are invalidated when its timeline changes,
+// see notifyingStore.
+type pageCache struct {
+	mu    sync.Mutex
+	all   uint64            // Generation of all the pages
+	gens  map[string]uint64 // Generation of each user's pages
+	pages map[string]*renderedPage
+}
+
+// newPageCache creates a new empty pageCache.
+func newPageCache() *pageCache {
+	return &pageCache{
+		gens:  make(map[string]uint64),
+		pages: make(map[string]*renderedPage),
+	}
+}
+
+// pageKey returns the key of the page of username seen by v.
+func pageKey(username string, v viewer) string {
+	return foldName(username) + ":" + strconv.Itoa(int(v))
+}
+
+// get returns the cached page of username seen by v, if any.
+func (c *pageCache) get(username string, v viewer) (*renderedPage, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	page, ok := c.pages[pageKey(username, v)]
+	return page, ok
+}
+
+// generation returns the current generation of the pages of username.
+// It must be read before loading the data of a page, and given back to
+// put.
+func (c *pageCache) generation(username string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.all + c.gens[foldName(username)]
+}
+
+// put caches the page of username seen by v, unless the pages of
+// username were invalidated after gen, so the page may be stale.
+func (c *pageCache) put(username string, v viewer, gen uint64,
+	page *renderedPage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.all+c.gens[foldName(username)] != gen {
+		return
+	}
+
+	// Make room by dropping any page.
+	if len(c.pages) >= pageCacheMax {
+		for k := range c.pages {
+			delete(c.pages, k)
+			break
+		}
+	}
+	c.pages[pageKey(username, v)] = page
+}
+
+// invalidate drops the cached pages of username.
+func (c *pageCache) invalidate(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gens[foldName(username)]++
+	delete(c.pages, pageKey(username, anonymous))
+	delete(c.pages, pageKey(username, owner))
+}
+
+// invalidateAll drops all the cached pages.
+func (c *pageCache) invalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.all++
+	c.pages = make(map[string]*renderedPage)
+}
+
+// notifyingStore is a Store that reports the users whose timeline
+// changed to a pageCache, after every write. A failed write may still
+// have changed something, so it is reported too.
+type notifyingStore struct {
+	Store
+	cache *pageCache
+}
+
+// AddPost implements Store.
+func (s notifyingStore) AddPost(ctx context.Context, p *Post) error {
+	err := s.Store.AddPost(ctx, p)
+	s.cache.invalidate(p.AuthorName)
+	return err
+}
+
+// EditPost implements Store.
+func (s notifyingStore) EditPost(ctx context.Context, p *Post, text string,
+	t int64) error {
+	err := s.Store.EditPost(ctx, p, text, t)
+	s.cache.invalidate(p.AuthorName)
+	return err
+}
+
+// DeletePost implements Store.
+func (s notifyingStore) DeletePost(ctx context.Context, p *Post) error {
+	err := s.Store.DeletePost(ctx, p)
+	s.cache.invalidate(p.AuthorName)
+	return err
+}
+
+// AddComment implements Store.
+func (s notifyingStore) AddComment(ctx context.Context, p *Post,
+	c *Comment) error {
+	err := s.Store.AddComment(ctx, p, c)
+	s.cache.invalidate(p.AuthorName)
+	return err
+}
+
+// DeleteComments implements Store.
+func (s notifyingStore) DeleteComments(ctx context.Context, p *Post,
+	ids []string) error {
+	err := s.Store.DeleteComments(ctx, p, ids)
+	s.cache.invalidate(p.AuthorName)
+	return err
+}
+
+// SetCommentsOff implements Store.
+func (s notifyingStore) SetCommentsOff(ctx context.Context, p *Post,
+	off bool) error {
+	err := s.Store.SetCommentsOff(ctx, p, off)
+	s.cache.invalidate(p.AuthorName)
+	return err
+}
+
+// LikePost implements Store.
+func (s notifyingStore) LikePost(ctx context.Context, p *Post,
+	username string, like bool, t int64) (int, error) {
+	n, err := s.Store.LikePost(ctx, p, username, like, t)
+	s.cache.invalidate(p.AuthorName)
+	return n, err
+}
+
+// Follow implements Store. Both profiles show the new follow counts.
+func (s notifyingStore) Follow(ctx context.Context, username, other string,
+	follow bool, t int64) error {
+	err := s.Store.Follow(ctx, username, other, follow, t)
+	s.cache.invalidate(username)
+	s.cache.invalidate(other)
+	return err
+}
+
+// Block implements Store. Both profiles hide the comments of the other
+// user and show the new follow counts.
+func (s notifyingStore) Block(ctx context.Context, username, other string,
+	block bool, t int64) error {
+	err := s.Store.Block(ctx, username, other, block, t)
+	s.cache.invalidate(username)
+	s.cache.invalidate(other)
+	return err
+}
+
+// Mute implements Store. The profile of the muter hides the comments of
+// the other user.
+func (s notifyingStore) Mute(ctx context.Context, username, other string,
+	mute bool, t int64) error {
+	err := s.Store.Mute(ctx, username, other, mute, t)
+	s.cache.invalidate(username)
+	return err
+}
+
+// AddMentions implements Store.
+func (s notifyingStore) AddMentions(ctx context.Context, p *Post,
+	usernames []string, t int64) error {
+	err := s.Store.AddMentions(ctx, p, usernames, t)
+	s.cache.invalidate(p.AuthorName)
+	return err
+}
+
+// Restore implements Store.
+func (s notifyingStore) Restore(ctx context.Context,
+	snap *Snapshot) error {
+	err := s.Store.Restore(ctx, snap)
+	s.cache.invalidateAll()
+	return err
+}
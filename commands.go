@@ -0,0 +1,57 @@
+/*
+Command line tools for GoPics.
+
+Copyright (c) 2015, Luca Chiricozzi. All rights reserved.
+Released under the MIT License.
+http://opensource.org/licenses/MIT
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// A command is a maintenance tool, run as "gopics [flags] name [args]"
+// instead of starting the server.
+type command struct {
+	Usage string
+	Run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"redis2bolt": {
+		Usage: "copy users, posts and timelines from Redis to -boltPath",
+		Run:   cmdRedisToBolt,
+	},
+	"export": {
+		Usage: "FILE, back up the data of -store and the media to FILE",
+		Run:   cmdExport,
+	},
+	"import": {
+		Usage: "FILE, restore the backup in FILE to -store and the media",
+		Run:   cmdImport,
+	},
+	"fsck": {
+		Usage: "[-repair], check media files against the posts in -store",
+		Run:   cmdFsck,
+	},
+	"migrate": {
+		Usage: "migrate the data of -store to the current schema",
+		Run:   cmdMigrate,
+	},
+}
+
+// runCommand runs the command named by the first of args, passing
+// it the others.
+func runCommand(args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Available commands:")
+		for name, c := range commands {
+			fmt.Fprintf(os.Stderr, "  %-12s %s\n", name, c.Usage)
+		}
+		return ErrUnknownCommand
+	}
+	return cmd.Run(args[1:])
+}
@@ -0,0 +1,108 @@
+/*
+A comment on a GoPics' post.
+
+Copyright (c) 2015, Luca Chiricozzi. All rights reserved.
+Released under the MIT License.
+http://opensource.org/licenses/MIT
+*/
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// Max length of the text of a comment, in characters.
+	maxCommentLen = 1000
+
+	// Deepest nesting level shown, deeper replies are shown at this
+	// level.
+	maxCommentDepth = 4
+)
+
+// A Comment on a post. Comments reply to the post itself or to another
+// comment on the same post.
+type Comment struct {
+	ID           string
+	PostName     string
+	Parent       string // ID of the comment replied to, if any
+	AuthorName   string
+	AuthorPicURL string
+	Text         string
+	Time         int64 // Unix time of publishing
+	Depth        int   `json:"-"` // Nesting level, see threadComments
+}
+
+// FormatTime returns the publishing time of the comment, formatted for
+// display.
+func (c Comment) FormatTime() string {
+	return time.Unix(c.Time, 0).Format(timeLayout)
+}
+
+// ISOTime returns the publishing time of the comment in RFC 3339 format.
+func (c Comment) ISOTime() string {
+	return time.Unix(c.Time, 0).Format(time.RFC3339)
+}
+
+// commentsByTime sorts comments by publishing time, then by ID.
+type commentsByTime []Comment
+
+func (cs commentsByTime) Len() int      { return len(cs) }
+func (cs commentsByTime) Swap(i, j int) { cs[i], cs[j] = cs[j], cs[i] }
+func (cs commentsByTime) Less(i, j int) bool {
+	if cs[i].Time != cs[j].Time {
+		return cs[i].Time < cs[j].Time
+	}
+	return cs[i].ID < cs[j].ID
+}
+
+// threadComments returns the comments of a post in reading order: every
+// comment is followed by its replies, oldest first, with its Depth set.
+// Replies to missing comments are shown as comments on the post.
+func threadComments(cs []Comment) []Comment {
+	sorted := append(commentsByTime(nil), cs...)
+	sort.Sort(sorted)
+
+	ids := make(map[string]bool)
+	for _, c := range sorted {
+		ids[c.ID] = true
+	}
+	replies := make(map[string][]Comment)
+	for _, c := range sorted {
+		parent := c.Parent
+		if !ids[parent] {
+			parent = ""
+		}
+		replies[parent] = append(replies[parent], c)
+	}
+
+	thread := []Comment{}
+	var walk func(parent string, depth int)
+	walk = func(parent string, depth int) {
+		for _, c := range replies[parent] {
+			c.Depth = depth
+			if c.Depth > maxCommentDepth {
+				c.Depth = maxCommentDepth
+			}
+			thread = append(thread, c)
+			walk(c.ID, depth+1)
+		}
+	}
+	walk("", 0)
+	return thread
+}
+
+// commentSubtree returns the IDs of the comment with the given id and of
+// all the replies to it, at any depth.
+func commentSubtree(cs []Comment, id string) []string {
+	ids := []string{id}
+	for i := 0; i < len(ids); i++ {
+		for _, c := range cs {
+			if c.Parent == ids[i] {
+				ids = append(ids, c.ID)
+			}
+		}
+	}
+	return ids
+}
@@ -17,5 +17,32 @@ func (ae appError) Error() string {
 	return ae.Err.Error()
 }
 
+// ErrUserExists is returned when a new user picks a taken name.
+var ErrUserExists = ErrValidation("A user with the same name already exist!")
+
+// ErrEmailExists is returned when a new user picks a taken email.
+var ErrEmailExists = ErrValidation("A user with the same email already exist!")
+
 var ErrInput = errors.New("error: invalid input type")
+var ErrTooManyImages = errors.New("error: too many images in a post")
 var ErrInvalidLength = errors.New("error: invalid content length")
+var ErrCommentsOff = errors.New("error: comments are off for this post")
+var ErrCommentText = errors.New("error: a comment must have between 1 " +
+	"and 1000 characters")
+var ErrCaptionText = errors.New("error: a caption can have at most " +
+	"2000 characters")
+var ErrForbidden = errors.New("error: forbidden")
+var ErrBlocked = errors.New("error: one of the users blocks the other")
+var ErrMethod = errors.New("error: method not allowed")
+var ErrNotFound = errors.New("error: not found")
+var ErrUnknownStore = errors.New("error: unknown store backend")
+var ErrUnknownCommand = errors.New("error: unknown command")
+var ErrNameCollision = errors.New("error: some usernames are equal once " +
+	"case folded, rename them and run migrate again")
+var ErrUsage = errors.New("error: wrong command arguments")
+var ErrArchive = errors.New("error: invalid backup archive")
+var ErrUnavailable = errors.New("error: the store is temporarily " +
+	"unavailable")
+var ErrReadOnly = errors.New("error: GoPics is temporarily read-only")
+var ErrSchema = errors.New("error: the data schema is not up to date, " +
+	"run gopics migrate")
@@ -0,0 +1,181 @@
+/*
+Consistency checks between media files and post records.
+
+Copyright (c) 2015, Luca Chiricozzi. All rights reserved.
+Released under the MIT License.
+http://opensource.org/licenses/MIT
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// handlePost stores a post before it renames the staged temporary files
+// of its images into the media directory, and import renames its staged
+// media files before it restores their posts. Posts and media files
+// younger than fsckGrace may still wait for those renames, so they are
+// never reported.
+const fsckGrace = time.Hour
+
+// cmdFsck looks for media files without a post, posts without a media
+// file and timeline entries without a post in the Store selected by
+// -store. It only reports them, unless -repair is given, then it deletes
+// the files, the posts and the entries. It also reports the users whose
+// names became reserved, which must be renamed by hand.
+func cmdFsck(args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := fs.Bool("repair", false, "delete what is found")
+	if err := fs.Parse(args); err != nil {
+		return ErrUsage
+	}
+
+	s, err := newStore(*storeBackend)
+	if err != nil {
+		return err
+	}
+	if err = checkSchema(s); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	snap, err := s.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(mediaPath...)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	files := make(map[string]bool)
+	for _, info := range infos {
+		// Skip .gitignore and the temporary files of uploads
+		if info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), ".") {
+			files[info.Name()] = true
+		}
+	}
+
+	found, failed := 0, 0
+	fix := func(err error) {
+		if err != nil {
+			failed++
+			log.Printf("fsck: repair failed: %v", err)
+		}
+	}
+
+	// Posts with missing media files
+	posts := make(map[string]bool)
+	for _, p := range snap.Posts {
+		posts[p.Name] = true
+		present, missing := []string{}, []string{}
+		for _, name := range p.Media() {
+			if files[name] {
+				delete(files, name)
+				present = append(present, name)
+				continue
+			}
+			missing = append(missing, name)
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		if time.Since(time.Unix(p.Time, 0)) < fsckGrace {
+			log.Printf("fsck: skipped the recent post %s of %s", p.Name,
+				p.AuthorName)
+			continue
+		}
+		for _, name := range missing {
+			log.Printf("fsck: post %s of %s has no media file %s", p.Name,
+				p.AuthorName, name)
+		}
+
+		// The other media files of the post go with it.
+		found++
+		if *repair {
+			p := p
+			if err := s.DeletePost(ctx, &p); err != nil {
+				fix(err)
+				continue
+			}
+			for _, name := range present {
+				fix(removeMedia(name))
+			}
+		}
+	}
+
+	// Timeline entries without a post
+	for name, members := range snap.Timelines {
+		for _, m := range members {
+			if posts[m.Member] {
+				continue
+			}
+
+			found++
+			log.Printf("fsck: timeline of %s lists the missing post %s",
+				name, m.Member)
+			if *repair {
+				fix(s.DeletePost(ctx, &Post{
+					AuthorName: name,
+					Name:       m.Member,
+					Time:       m.Score,
+				}))
+			}
+		}
+	}
+
+	// Media files without a post
+	for _, info := range infos {
+		if !files[info.Name()] {
+			continue
+		}
+		if time.Since(info.ModTime()) < fsckGrace {
+			log.Printf("fsck: skipped the recent file %s", info.Name())
+			continue
+		}
+
+		found++
+		log.Printf("fsck: media file %s has no post", info.Name())
+		if *repair {
+			fix(os.Remove(filepath.Join(dir, info.Name())))
+		}
+	}
+
+	if n := reportReserved(snap.Users); n > 0 {
+		log.Printf("fsck: %d users have reserved names, their pages "+
+			"cannot be reached until they are renamed", n)
+	}
+
+	switch {
+	case found == 0:
+		log.Printf("fsck: no problems found")
+	case *repair:
+		log.Printf("fsck: %d problems found, %d repaired", found,
+			found-failed)
+	default:
+		log.Printf("fsck: %d problems found, run with -repair to fix them",
+			found)
+	}
+	return nil
+}
+
+// reportReserved logs the users whose names are taken by the paths of
+// GoPics, see reservedName, and returns how many they are. They were
+// registered before their names were reserved.
+func reportReserved(users []User) int {
+	n := 0
+	for _, usr := range users {
+		if reservedName(usr.Name) {
+			n++
+			log.Printf("fsck: user %s has a reserved name", usr.Name)
+		}
+	}
+	return n
+}
@@ -8,29 +8,36 @@ http://opensource.org/licenses/MIT
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"image"
-	"image/jpeg"
 	_ "image/png"
+	"log"
 	"net/http"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
-	"time"
+	"unicode/utf8"
 
 	"code.google.com/p/go-uuid/uuid"
-	"github.com/garyburd/redigo/redis"
 	"github.com/lucachr/gopics/auth"
 	"github.com/lucachr/gopics/flash"
-	"github.com/nfnt/resize"
+	"github.com/lucachr/gopics/reutils"
 	"golang.org/x/crypto/bcrypt"
 )
 
 const (
 
+	// Max size of the pictures of a post, all together.
+	maxPostBytes  = 10485760 // 10MB
+	maxPostImages = 10
+
 	// Max picture sizes
-	maxPicBytes = 2097152 // 2MB
-	maxWidth    = 800
-	maxHeight   = 600
+	maxWidth  = 800
+	maxHeight = 600
+
+	// Seconds a client should wait before retrying an unavailable page.
+	retryAfter = 5
 )
 
 // appHandler is an handler that takes a Page and returns a pointer to an
@@ -38,6 +45,9 @@ const (
 type appHandler func(http.ResponseWriter, *http.Request, *Page) *appError
 
 func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r, cancel := withTimeout(r)
+	defer cancel()
+
 	// Check for validation error in the form
 	msg, err := flash.GetCookie(w, r)
 	switch {
@@ -55,15 +65,28 @@ func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	httpAppError(w, fn(w, r, p))
 }
 
-// redisHandler is a request handler that needs a connection to Redis and
+// storeHandler is a request handler that needs access to the Store and
 // returns a pointer to an appError.
-type redisHandler func(http.ResponseWriter, *http.Request, redis.Conn) *appError
+type storeHandler func(http.ResponseWriter, *http.Request, Store) *appError
 
-func (fn redisHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	conn := pool.Get()
-	defer conn.Close()
+func (fn storeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Do not even try to write while the store is failing.
+	if storeBreaker.isOpen() {
+		httpAppError(w, &appError{
+			Err:  ErrReadOnly,
+			Code: http.StatusServiceUnavailable,
+		})
+		return
+	}
+
+	r, cancel := withTimeout(r)
+	defer cancel()
 
-	httpAppError(w, fn(w, r, conn))
+	ae := fn(w, r, store)
+	if ae != nil && ae.Err == ErrUnavailable {
+		ae.Err = ErrReadOnly
+	}
+	httpAppError(w, ae)
 }
 
 // login sets an auth cookie with the given username and redirect the
@@ -82,7 +105,7 @@ func login(w http.ResponseWriter, r *http.Request, username string) *appError {
 
 // handleRegistration handles the registration of a new user to GoPics.
 func handleRegistration(w http.ResponseWriter, r *http.Request,
-	conn redis.Conn) *appError {
+	s Store) *appError {
 	// Create a new user an get user's detail from the form
 	usr := new(User)
 	usr.Name = r.FormValue("name")
@@ -90,16 +113,13 @@ func handleRegistration(w http.ResponseWriter, r *http.Request,
 	usr.Password = []byte(r.FormValue("password"))
 
 	// Validate the user credentials.
-	err := usr.validate(conn)
+	err := usr.validate(r.Context(), s)
 	switch err.(type) {
 	case ErrValidation:
 		return setFlashAndRedirect(w, r, "/register", err.Error())
 	case nil: // Do nothing
 	default:
-		return &appError{
-			Err:  err,
-			Code: http.StatusInternalServerError,
-		}
+		return storeError(err)
 	}
 
 	// Hash the user password
@@ -113,12 +133,15 @@ func handleRegistration(w http.ResponseWriter, r *http.Request,
 	}
 	usr.Password = pass
 
-	// All right, register the new user.
-	if err = usr.save(conn); err != nil {
-		return &appError{
-			Err:  err,
-			Code: http.StatusInternalServerError,
-		}
+	// All right, register the new user, unless someone else
+	// registered the same name in the meantime.
+	err = usr.save(r.Context(), s)
+	switch err.(type) {
+	case ErrValidation:
+		return setFlashAndRedirect(w, r, "/register", err.Error())
+	case nil: // Do nothing
+	default:
+		return storeError(err)
 	}
 
 	return login(w, r, usr.Name)
@@ -126,20 +149,17 @@ func handleRegistration(w http.ResponseWriter, r *http.Request,
 
 // handleLogin manages the login of the users
 func handleLogin(w http.ResponseWriter, r *http.Request,
-	conn redis.Conn) *appError {
+	s Store) *appError {
 
-	// Get user credential from Redis
-	usr, err := redisGetUser(conn, r.FormValue("name"))
+	// Get user credential from the store
+	usr, err := s.GetUser(r.Context(), r.FormValue("name"))
 	switch {
-	case err == redis.ErrNil:
+	case err == ErrNotFound:
 		// The user does not exist.
 		return setFlashAndRedirect(w, r, "/",
 			"Invalid username or password.")
 	case err != nil:
-		return &appError{
-			Err:  err,
-			Code: http.StatusInternalServerError,
-		}
+		return storeError(err)
 	}
 
 	// Check if the submitted password and the user's one match.
@@ -213,31 +233,206 @@ func handleRegister(w http.ResponseWriter, r *http.Request, p *Page) *appError {
 // handleTimeLine manages the users' timelines
 func handleTimeline(w http.ResponseWriter, r *http.Request, p *Page,
 	username string) *appError {
-	conn := pool.Get()
-	defer conn.Close()
+	// If an user is logged, get her name.
+	logName, err := auth.GetCookie(r, keyring)
+	if err != nil && err != http.ErrNoCookie {
+		return &appError{
+			Err:  err,
+			Code: http.StatusBadRequest,
+		}
+	}
+
+	tab := r.FormValue("tab")
+	if tab != "" && tab != "likes" && tab != "mentions" {
+		http.NotFound(w, r)
+		return nil
+	}
 
-	// Get user's data from Redis
-	usr, err := redisGetUser(conn, username)
+	// The first page of posts is cached for anonymous users and for the
+	// owner of the timeline, who see the same page at every request.
+	v, cache := anonymous, r.FormValue("before") == "" && tab == ""
 	switch {
-	case err == redis.ErrNil:
+	case logName == "":
+	case foldName(logName) == foldName(username):
+		v = owner
+	default:
+		cache = false
+	}
+	if cache {
+		if page, ok := timelines.get(username, v); ok {
+			writePage(w, r, page)
+			return nil
+		}
+	}
+	gen := timelines.generation(username)
+
+	// Get user's data from the store
+	usr, err := store.GetUser(r.Context(), username)
+	switch {
+	case err == ErrNotFound:
 		http.NotFound(w, r)
 		return nil
 	case err != nil:
+		return storeError(err)
+	}
+
+	// Get the follow counts, and whether the logged user follows,
+	// blocks or mutes the owner of the timeline.
+	p.Followers, p.Following, err = store.GetFollowCounts(r.Context(),
+		usr.Name)
+	if err != nil {
+		return storeError(err)
+	}
+	blocks, err := viewerBlocks(r.Context(), store, logName)
+	if err != nil {
+		return storeError(err)
+	}
+	if v != owner && logName != "" {
+		p.Followed, err = store.IsFollowing(r.Context(), logName, usr.Name)
+		if err != nil {
+			return storeError(err)
+		}
+		name := foldName(usr.Name)
+		p.Blocked = blocks.Blocking[name]
+		p.BlockedBy = blocks.Blockers[name]
+		p.Muted = blocks.Muting[name]
+	}
+
+	// Create the requested page of the user's timeline.
+	before, err := formCursor(r)
+	if err != nil {
 		return &appError{
 			Err:  err,
-			Code: http.StatusInternalServerError,
+			Code: http.StatusBadRequest,
+		}
+	}
+	switch tab {
+	case "likes":
+		p.Posts, p.Next, err = store.GetLikedPosts(r.Context(),
+			usr.Name, before, timelinePageLen)
+	case "mentions":
+		p.Posts, p.Next, err = store.GetMentionPosts(r.Context(),
+			usr.Name, before, timelinePageLen)
+	default:
+		p.Posts, p.Next, err = store.GetTimeline(r.Context(),
+			usr.Name, before, timelinePageLen)
+	}
+	if err != nil {
+		return storeError(err)
+	}
+	p.Posts, err = addPostDetails(r.Context(), store, p.Posts, logName,
+		blocks)
+	if err != nil {
+		return storeError(err)
+	}
+
+	// Set the page data and display it
+	p.Title = pageTitle + usr.Name
+	p.User = usr
+	p.LoggedUser = logName
+	p.Tab = tab
+
+	page, ae := renderPage("timeline", p)
+	if ae != nil {
+		return ae
+	}
+	if cache {
+		timelines.put(username, v, gen, page)
+	}
+	writePage(w, r, page)
+	return nil
+}
+
+// handleTag shows the posts with the hashtag in the path, newest first.
+func handleTag(w http.ResponseWriter, r *http.Request, p *Page) *appError {
+	tag := r.URL.Path[len("/tag/"):]
+	if !reutils.MatchTag(tag) {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	// If an user is logged, get her name.
+	logName, err := auth.GetCookie(r, keyring)
+	if err != nil && err != http.ErrNoCookie {
+		return &appError{
+			Err:  err,
+			Code: http.StatusBadRequest,
 		}
 	}
 
-	// Create the timeline of the user.
-	usr.Posts, err = redisGetPosts(conn, userTimeline+usr.Name)
+	before, err := formCursor(r)
 	if err != nil {
 		return &appError{
 			Err:  err,
-			Code: http.StatusInternalServerError,
+			Code: http.StatusBadRequest,
 		}
 	}
+	p.Tag = foldTag(tag)
+	p.Posts, p.Next, err = store.GetTagPosts(r.Context(), p.Tag, before,
+		timelinePageLen)
+	if err != nil {
+		return storeError(err)
+	}
+	blocks, err := viewerBlocks(r.Context(), store, logName)
+	if err != nil {
+		return storeError(err)
+	}
+	p.Posts, err = addPostDetails(r.Context(), store, p.Posts, logName,
+		blocks)
+	if err != nil {
+		return storeError(err)
+	}
 
+	p.Title = pageTitle + "#" + p.Tag
+	p.LoggedUser = logName
+	return renderTemplate(w, "tag", p)
+}
+
+// handleFeed shows the feed of the logged user, the posts of the users
+// she follows, newest first.
+func handleFeed(w http.ResponseWriter, r *http.Request, p *Page) *appError {
+	logName, err := auth.GetCookie(r, keyring)
+	switch {
+	case err == http.ErrNoCookie:
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return nil
+	case err != nil:
+		return &appError{
+			Err:  err,
+			Code: http.StatusBadRequest,
+		}
+	}
+
+	before, err := formCursor(r)
+	if err != nil {
+		return &appError{
+			Err:  err,
+			Code: http.StatusBadRequest,
+		}
+	}
+	p.Posts, p.Next, err = store.GetFeed(r.Context(), logName, before,
+		timelinePageLen)
+	if err != nil {
+		return storeError(err)
+	}
+	blocks, err := store.GetBlocks(r.Context(), logName)
+	if err != nil {
+		return storeError(err)
+	}
+	p.Posts, err = addPostDetails(r.Context(), store, p.Posts, logName,
+		blocks)
+	if err != nil {
+		return storeError(err)
+	}
+
+	p.Title = pageTitle + "Feed"
+	p.LoggedUser = logName
+	return renderTemplate(w, "feed", p)
+}
+
+// handlePermalink shows the post named in the path on a page of its own.
+func handlePermalink(w http.ResponseWriter, r *http.Request,
+	p *Page) *appError {
 	// If an user is logged, get her name.
 	logName, err := auth.GetCookie(r, keyring)
 	if err != nil && err != http.ErrNoCookie {
@@ -247,19 +442,87 @@ func handleTimeline(w http.ResponseWriter, r *http.Request, p *Page,
 		}
 	}
 
-	// Set the page data and display it
-	p.Title = pageTitle + username
-	p.User = usr
+	post, err := store.GetPost(r.Context(), r.URL.Path[len("/p/"):])
+	switch {
+	case err == ErrNotFound:
+		http.NotFound(w, r)
+		return nil
+	case err != nil:
+		return storeError(err)
+	}
+
+	blocks, err := viewerBlocks(r.Context(), store, logName)
+	if err != nil {
+		return storeError(err)
+	}
+	p.Posts, err = addPostDetails(r.Context(), store, []Post{*post},
+		logName, blocks)
+	if err != nil {
+		return storeError(err)
+	}
+	if len(p.Posts) == 0 {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	p.Title = pageTitle + post.AuthorName
 	p.LoggedUser = logName
+	return renderTemplate(w, "post", p)
+}
 
-	return renderTemplate(w, "timeline", p)
+// formCursor returns the cursor of the requested page of posts, 0 for
+// the first page.
+func formCursor(r *http.Request) (int64, error) {
+	c := r.FormValue("before")
+	if c == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(c, 10, 64)
 }
 
-// handlePost manages posts submission.
-func handlePost(w http.ResponseWriter, r *http.Request,
-	conn redis.Conn) *appError {
-	var img image.Image
+// addPostDetails sets the comments, the likes and the mentioned users of
+// the given posts, for the logged user with the given name and Blocks.
+// It returns the posts that b does not hide, without the hidden comments,
+// likes and mentions.
+func addPostDetails(ctx context.Context, s Store, posts []Post,
+	logName string, b *Blocks) ([]Post, error) {
+	posts = visiblePosts(posts, b)
+	names := []string{}
+	for _, post := range posts {
+		names = append(names, post.Name)
+	}
+
+	comments, err := s.GetComments(ctx, names)
+	if err != nil {
+		return nil, err
+	}
+	likers, err := s.GetLikers(ctx, names)
+	if err != nil {
+		return nil, err
+	}
+	mentioned, err := s.GetMentioned(ctx, names)
+	if err != nil {
+		return nil, err
+	}
 
+	for i := range posts {
+		posts[i].Comments = threadComments(
+			visibleComments(comments[posts[i].Name], b))
+		posts[i].LikedBy = visibleNames(likers[posts[i].Name], b)
+		posts[i].Mentioned = visibleNames(mentioned[posts[i].Name], b)
+		for _, name := range posts[i].LikedBy {
+			if logName != "" && foldName(name) == foldName(logName) {
+				posts[i].Liked = true
+			}
+		}
+	}
+	return posts, nil
+}
+
+// handlePost manages posts submission. A post holds one or more
+// pictures, shown in the order they are sent.
+func handlePost(w http.ResponseWriter, r *http.Request,
+	s Store) *appError {
 	// Get the username from the auth cookie
 	username, err := auth.GetCookie(r, keyring)
 	if err != nil {
@@ -276,109 +539,593 @@ func handlePost(w http.ResponseWriter, r *http.Request,
 			Err:  ErrInvalidLength,
 			Code: http.StatusLengthRequired,
 		}
-	case r.ContentLength > maxPicBytes:
+	case r.ContentLength > maxPostBytes:
 		return &appError{
 			Err:  ErrInvalidLength,
 			Code: http.StatusRequestEntityTooLarge,
 		}
 	}
 
-	// Read only the first maxPicBytes of the request's body
-	r.Body = http.MaxBytesReader(w, r.Body, maxPicBytes)
+	// Read only the first maxPostBytes of the request's body
+	r.Body = http.MaxBytesReader(w, r.Body, maxPostBytes)
+	if err = r.ParseMultipartForm(maxPostBytes); err != nil {
+		return &appError{
+			Err:  err,
+			Code: http.StatusBadRequest,
+		}
+	}
+	defer r.MultipartForm.RemoveAll()
 
-	// Try to get the content of the form picture field
-	f, _, err := r.FormFile("picture")
-	if err != nil {
+	if utf8.RuneCountInString(r.FormValue("text")) > maxCaptionLen {
+		return &appError{
+			Err:  ErrCaptionText,
+			Code: http.StatusBadRequest,
+		}
+	}
+
+	// Get the pictures of the form
+	files := r.MultipartForm.File["picture"]
+	switch {
+	case len(files) == 0:
 		return &appError{
+			Err:  http.ErrMissingFile,
+			Code: http.StatusBadRequest,
+		}
+	case len(files) > maxPostImages:
+		return &appError{
+			Err:  ErrTooManyImages,
+			Code: http.StatusBadRequest,
+		}
+	}
+
+	// Resize every picture and write it in a temporary file, they become
+	// the media files of the post only when the post is stored. They are
+	// removed on any error.
+	tmps := []string{}
+	defer func() {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}()
+	for _, fh := range files {
+		f, err := fh.Open()
+		if err != nil {
+			return &appError{
+				Err:  err,
+				Code: http.StatusBadRequest,
+			}
+		}
+
+		// Try to decode the content of f as an image
+		src, _, err := image.Decode(f)
+		f.Close()
+		if err != nil {
+			return &appError{
+				Err:  err,
+				Code: http.StatusUnsupportedMediaType,
+			}
+		}
+
+		tmp, err := writeTempJPEG(fitImage(src))
+		if err != nil {
+			return &appError{
+				Err:  err,
+				Code: http.StatusInternalServerError,
+			}
+		}
+		tmps = append(tmps, tmp)
+	}
+
+	// The image names are generated as uuids, the post is named as its
+	// first image.
+	images := stringList{}
+	for range tmps {
+		images = append(images, uuid.New()+".jpeg")
+	}
+
+	// Build the post
+	p := new(Post)
+	p.Name = images[0]
+	p.Images = images
+	p.Text = r.FormValue("text")
+	p.Tags = postTags(p.Text)
+	p.Time = unixTimeNow()
+
+	// Get the author data from the store
+	usr, err := s.GetUser(r.Context(), username)
+	if err != nil {
+		return storeError(err)
+	}
+
+	// Add the author data
+	p.AuthorName = usr.Name
+	p.AuthorPicURL = usr.PicURL
+
+	// Create the post and add it to the user timeline. On an error the
+	// post may be stored anyway, without its images, and fsck reports it.
+	if err = s.AddPost(r.Context(), p); err != nil {
+		return storeError(err)
+	}
+
+	// Publish the images, or take the post back. The published images are
+	// removed only if the post is surely gone, otherwise fsck reports them.
+	for i, tmp := range tmps {
+		if err = commitMedia(tmp, images[i]); err != nil {
+			derr := s.DeletePost(context.Background(), p)
+			if derr != nil {
+				log.Printf("post: taking back %s of %s: %v", p.Name,
+					usr.Name, derr)
+				return &appError{
+					Err:  err,
+					Code: http.StatusInternalServerError,
+				}
+			}
+			for _, name := range images[:i] {
+				if derr = removeMedia(name); derr != nil {
+					log.Printf("post: removing media file %s: %v",
+						name, derr)
+				}
+			}
+			return &appError{
+				Err:  err,
+				Code: http.StatusInternalServerError,
+			}
+		}
+	}
+
+	// The post is published, a failure to notify the mentioned users
+	// must not turn it into an error.
+	err = addMentions(r.Context(), s, p, p.Text, usr.Name, p.Time)
+	if err != nil {
+		log.Printf("post: mentions of %s of %s: %v", p.Name, usr.Name, err)
+	}
+
+	// All right, redirect to the home.
+	http.Redirect(w, r, "/"+usr.Name, http.StatusSeeOther)
+	return nil
+}
+
+// formPost returns the post named in the form of a POST request and the
+// name of the logged user.
+func formPost(w http.ResponseWriter, r *http.Request, s Store) (*Post,
+	string, *appError) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		return nil, "", &appError{
+			Err:  ErrMethod,
+			Code: http.StatusMethodNotAllowed,
+		}
+	}
+
+	// Get the username from the auth cookie
+	username, err := auth.GetCookie(r, keyring)
+	if err != nil {
+		return nil, "", &appError{
+			Err:  err,
+			Code: http.StatusBadRequest,
+		}
+	}
+
+	p, err := s.GetPost(r.Context(), r.FormValue("name"))
+	switch {
+	case err == ErrNotFound:
+		return nil, "", &appError{
 			Err:  err,
+			Code: http.StatusNotFound,
+		}
+	case err != nil:
+		return nil, "", storeError(err)
+	}
+	return p, username, nil
+}
+
+// ownPost returns the post named in the form of a POST request, if the
+// logged user is its author.
+func ownPost(w http.ResponseWriter, r *http.Request, s Store) (*Post,
+	string, *appError) {
+	p, username, ae := formPost(w, r, s)
+	if ae != nil {
+		return nil, "", ae
+	}
+
+	// Only the author can change a post.
+	if foldName(p.AuthorName) != foldName(username) {
+		return nil, "", &appError{
+			Err:  ErrForbidden,
+			Code: http.StatusForbidden,
+		}
+	}
+	return p, username, nil
+}
+
+// handleEdit changes the caption of a post. Only the author of the post
+// can edit it.
+func handleEdit(w http.ResponseWriter, r *http.Request,
+	s Store) *appError {
+	p, username, ae := ownPost(w, r, s)
+	if ae != nil {
+		return ae
+	}
+
+	text := r.FormValue("text")
+	if utf8.RuneCountInString(text) > maxCaptionLen {
+		return &appError{
+			Err:  ErrCaptionText,
+			Code: http.StatusBadRequest,
+		}
+	}
+	if text != p.Text {
+		t := unixTimeNow()
+		err := s.EditPost(r.Context(), p, text, t)
+		if err == ErrNotFound {
+			return &appError{
+				Err:  err,
+				Code: http.StatusNotFound,
+			}
+		}
+		if err != nil {
+			return storeError(err)
+		}
+		// The edit is stored, a failure to notify the mentioned users
+		// must not turn it into an error.
+		err = addMentions(r.Context(), s, p, text, username, t)
+		if err != nil {
+			log.Printf("edit: mentions of %s of %s: %v", p.Name, username,
+				err)
+		}
+	}
+
+	http.Redirect(w, r, "/"+username, http.StatusSeeOther)
+	return nil
+}
+
+// handleDelete deletes a post and its media file. Only the author of the
+// post can delete it.
+func handleDelete(w http.ResponseWriter, r *http.Request,
+	s Store) *appError {
+	p, username, ae := ownPost(w, r, s)
+	if ae != nil {
+		return ae
+	}
+
+	// Remove the post first, media files without a post are only
+	// garbage, found by fsck.
+	err := s.DeletePost(r.Context(), p)
+	if err != nil {
+		return storeError(err)
+	}
+	for _, name := range p.Media() {
+		if err = removeMedia(name); err != nil {
+			return &appError{
+				Err:  err,
+				Code: http.StatusInternalServerError,
+			}
+		}
+	}
+
+	http.Redirect(w, r, "/"+username, http.StatusSeeOther)
+	return nil
+}
+
+// handleComment adds a comment to a post, or a reply to a comment.
+func handleComment(w http.ResponseWriter, r *http.Request,
+	s Store) *appError {
+	p, username, ae := formPost(w, r, s)
+	if ae != nil {
+		return ae
+	}
+
+	text := strings.TrimSpace(r.FormValue("text"))
+	if text == "" || utf8.RuneCountInString(text) > maxCommentLen {
+		return &appError{
+			Err:  ErrCommentText,
 			Code: http.StatusBadRequest,
 		}
 	}
 
-	// Try to decode the content of f as an image
-	src, _, err := image.Decode(f)
+	// Get the author data from the store
+	usr, err := s.GetUser(r.Context(), username)
+	if err != nil {
+		return storeError(err)
+	}
+
+	// Users who block each other cannot comment on their posts, nor
+	// reply to their comments.
+	blocks, err := s.GetBlocks(r.Context(), usr.Name)
 	if err != nil {
+		return storeError(err)
+	}
+	parent := r.FormValue("parent")
+	blocked := blocks.blocked(p.AuthorName)
+	if !blocked && parent != "" {
+		comments, err := s.GetComments(r.Context(), []string{p.Name})
+		if err != nil {
+			return storeError(err)
+		}
+		for _, other := range comments[p.Name] {
+			if other.ID == parent {
+				blocked = blocks.blocked(other.AuthorName)
+			}
+		}
+	}
+	if blocked {
+		return &appError{
+			Err:  ErrBlocked,
+			Code: http.StatusForbidden,
+		}
+	}
+
+	c := &Comment{
+		ID:           uuid.New(),
+		PostName:     p.Name,
+		Parent:       parent,
+		AuthorName:   usr.Name,
+		AuthorPicURL: usr.PicURL,
+		Text:         text,
+		Time:         unixTimeNow(),
+	}
+	err = s.AddComment(r.Context(), p, c)
+	switch {
+	case err == ErrNotFound:
+		return &appError{
+			Err:  err,
+			Code: http.StatusNotFound,
+		}
+	case err == ErrCommentsOff:
 		return &appError{
 			Err:  err,
-			Code: http.StatusUnsupportedMediaType,
+			Code: http.StatusForbidden,
 		}
+	case err != nil:
+		return storeError(err)
 	}
 
-	// Get the ratio d of the image
-	bound := src.Bounds()
-	x, y := bound.Max.X, bound.Max.Y
-	d := float32(x) / float32(y)
+	// The comment is stored, a failure to notify the mentioned users
+	// must not turn it into an error.
+	err = addMentions(r.Context(), s, p, text, usr.Name, c.Time)
+	if err != nil {
+		log.Printf("comment: mentions of %s on %s: %v", c.ID, p.Name, err)
+	}
+
+	http.Redirect(w, r, "/"+p.AuthorName, http.StatusSeeOther)
+	return nil
+}
+
+// handleDeleteComment deletes a comment and the replies to it. The
+// author of the comment and the author of the post can delete it.
+func handleDeleteComment(w http.ResponseWriter, r *http.Request,
+	s Store) *appError {
+	p, username, ae := formPost(w, r, s)
+	if ae != nil {
+		return ae
+	}
 
-	// Check the image sizes
-	if x > maxWidth || y > maxHeight {
-		if x > y {
-			img = resize.Resize(uint(maxWidth), uint(1/d*maxWidth),
-				src, resize.Lanczos3)
+	comments, err := s.GetComments(r.Context(), []string{p.Name})
+	if err != nil {
+		return storeError(err)
+	}
+	cs := comments[p.Name]
 
-		} else {
-			img = resize.Resize(uint(d*maxHeight), uint(maxHeight),
-				src, resize.Lanczos3)
+	id := r.FormValue("id")
+	var c *Comment
+	for i := range cs {
+		if cs[i].ID == id {
+			c = &cs[i]
+		}
+	}
+	switch {
+	case c == nil:
+		return &appError{
+			Err:  ErrNotFound,
+			Code: http.StatusNotFound,
+		}
+	case foldName(c.AuthorName) != foldName(username) &&
+		foldName(p.AuthorName) != foldName(username):
+		return &appError{
+			Err:  ErrForbidden,
+			Code: http.StatusForbidden,
 		}
-	} else {
-		img = resize.Resize(uint(x), uint(y), src, resize.Lanczos3)
+	}
 
+	err = s.DeleteComments(r.Context(), p, commentSubtree(cs, id))
+	if err != nil {
+		return storeError(err)
 	}
 
-	// The image name is generated as an uuid
-	picName := uuid.New() + ".jpeg"
-	path := append(mediaPath, picName)
+	http.Redirect(w, r, "/"+p.AuthorName, http.StatusSeeOther)
+	return nil
+}
+
+// handleCommentsOff turns the comments on a post off, or back on. Only
+// the author of the post can do it.
+func handleCommentsOff(w http.ResponseWriter, r *http.Request,
+	s Store) *appError {
+	p, username, ae := ownPost(w, r, s)
+	if ae != nil {
+		return ae
+	}
 
-	// Create a new file
-	dst, err := os.Create(filepath.Join(path...))
+	err := s.SetCommentsOff(r.Context(), p, r.FormValue("off") == "1")
+	if err == ErrNotFound {
+		return &appError{
+			Err:  err,
+			Code: http.StatusNotFound,
+		}
+	}
 	if err != nil {
+		return storeError(err)
+	}
+
+	http.Redirect(w, r, "/"+username, http.StatusSeeOther)
+	return nil
+}
+
+// handleFollow makes the logged user follow the user named in the form,
+// or stop following her, and redirects to her timeline.
+func handleFollow(w http.ResponseWriter, r *http.Request,
+	s Store) *appError {
+	username, other, ae := formOtherUser(w, r)
+	if ae != nil {
+		return ae
+	}
+
+	follow := r.FormValue("follow") == "1"
+	err := s.Follow(r.Context(), username, other, follow, unixTimeNow())
+	switch {
+	case err == ErrNotFound:
 		return &appError{
 			Err:  err,
-			Code: http.StatusInternalServerError,
+			Code: http.StatusNotFound,
+		}
+	case err == ErrBlocked:
+		return &appError{
+			Err:  err,
+			Code: http.StatusForbidden,
 		}
+	case err != nil:
+		return storeError(err)
 	}
-	defer dst.Close()
 
-	// Write the image in the file
-	err = jpeg.Encode(dst, img, nil)
+	http.Redirect(w, r, "/"+other, http.StatusSeeOther)
+	return nil
+}
+
+// handleBlock makes the logged user block the user named in the form,
+// or unblock her, and redirects to her timeline.
+func handleBlock(w http.ResponseWriter, r *http.Request,
+	s Store) *appError {
+	username, other, ae := formOtherUser(w, r)
+	if ae != nil {
+		return ae
+	}
+
+	block := r.FormValue("block") == "1"
+	err := s.Block(r.Context(), username, other, block, unixTimeNow())
+	if err == ErrNotFound {
+		return &appError{
+			Err:  err,
+			Code: http.StatusNotFound,
+		}
+	}
 	if err != nil {
+		return storeError(err)
+	}
+
+	http.Redirect(w, r, "/"+other, http.StatusSeeOther)
+	return nil
+}
+
+// handleMute makes the logged user mute the user named in the form, or
+// unmute her, and redirects to her timeline.
+func handleMute(w http.ResponseWriter, r *http.Request,
+	s Store) *appError {
+	username, other, ae := formOtherUser(w, r)
+	if ae != nil {
+		return ae
+	}
+
+	mute := r.FormValue("mute") == "1"
+	err := s.Mute(r.Context(), username, other, mute, unixTimeNow())
+	if err == ErrNotFound {
 		return &appError{
 			Err:  err,
-			Code: http.StatusInternalServerError,
+			Code: http.StatusNotFound,
 		}
 	}
+	if err != nil {
+		return storeError(err)
+	}
 
-	// Build the post
-	p := new(Post)
-	p.Name = picName
-	p.Text = r.FormValue("text")
-	p.Time = time.Now().Format(timeLayout)
+	http.Redirect(w, r, "/"+other, http.StatusSeeOther)
+	return nil
+}
+
+// formOtherUser checks a POST request about another user and returns
+// the name of the logged user and the name of the other user, from the
+// form.
+func formOtherUser(w http.ResponseWriter, r *http.Request) (string, string,
+	*appError) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		return "", "", &appError{
+			Err:  ErrMethod,
+			Code: http.StatusMethodNotAllowed,
+		}
+	}
+
+	username, err := auth.GetCookie(r, keyring)
+	if err != nil {
+		return "", "", &appError{
+			Err:  err,
+			Code: http.StatusBadRequest,
+		}
+	}
+
+	other := r.FormValue("name")
+	if foldName(other) == foldName(username) {
+		return "", "", &appError{
+			Err:  ErrInput,
+			Code: http.StatusBadRequest,
+		}
+	}
+	return username, other, nil
+}
+
+// handleLike likes a post, or takes the like back. Requests sent with
+// XMLHttpRequest get the new number of likes the user can see as JSON,
+// the others are redirected to the timeline of the post.
+func handleLike(w http.ResponseWriter, r *http.Request,
+	s Store) *appError {
+	p, username, ae := formPost(w, r, s)
+	if ae != nil {
+		return ae
+	}
 
-	// Get the author data from Redis
-	usr, err := redisGetUser(conn, username)
+	// Users who block each other cannot like their posts, a like given
+	// before can still be taken back.
+	blocks, err := s.GetBlocks(r.Context(), username)
 	if err != nil {
+		return storeError(err)
+	}
+	like := r.FormValue("like") == "1"
+	if like && blocks.blocked(p.AuthorName) {
+		return &appError{
+			Err:  ErrBlocked,
+			Code: http.StatusForbidden,
+		}
+	}
+	_, err = s.LikePost(r.Context(), p, username, like, unixTimeNow())
+	if err == ErrNotFound {
 		return &appError{
 			Err:  err,
-			Code: http.StatusInternalServerError,
+			Code: http.StatusNotFound,
 		}
 	}
+	if err != nil {
+		return storeError(err)
+	}
 
-	// Add the author data
-	p.AuthorName = usr.Name
-	p.AuthorPicURL = usr.PicURL
+	if r.Header.Get("X-Requested-With") != "XMLHttpRequest" {
+		http.Redirect(w, r, "/"+p.AuthorName, http.StatusSeeOther)
+		return nil
+	}
+	// Count the likes the user can see, as the page does.
+	likers, err := s.GetLikers(r.Context(), []string{p.Name})
+	if err != nil {
+		return storeError(err)
+	}
+	n := len(visibleNames(likers[p.Name], blocks))
 
-	// Create the post and add it to the user timeline
-	conn.Send("MULTI")
-	conn.Send("HMSET", redisFlat(postTag+p.Name, p)...)
-	conn.Send("ZADD", userTimeline+usr.Name, unixTimeNow(), p.Name)
-	_, err = conn.Do("EXEC")
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(struct {
+		Likes int  `json:"likes"`
+		Liked bool `json:"liked"`
+	}{n, like})
 	if err != nil {
 		return &appError{
 			Err:  err,
 			Code: http.StatusInternalServerError,
 		}
 	}
-
-	// All right, redirect to the home.
-	http.Redirect(w, r, "/"+usr.Name, http.StatusSeeOther)
 	return nil
 }
@@ -15,16 +15,54 @@ import (
 )
 
 func main() {
-	// Create a new Redis pool
 	flag.Parse()
-	pool = newPool(*redisServer)
+
+	// Run a command instead of the server, if one is given
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args()); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	// Create the Store with the chosen backend
+	s, err := newStore(*storeBackend)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err = initSchema(s); err != nil {
+		log.Fatalln(err)
+	}
+	if err = checkSchema(s); err != nil {
+		log.Fatalln(err)
+	}
+	// Redis fills the feeds in the background, see runFanOut.
+	if rs, ok := s.(*redisStore); ok {
+		go rs.runFanOut()
+	}
+	store = notifyingStore{
+		Store: breakerStore{Store: s, b: storeBreaker},
+		cache: timelines,
+	}
 
 	http.Handle("/", appHandler(handleRoot))
 	http.Handle("/register", appHandler(handleRegister))
-	http.Handle("/registration", redisHandler(handleRegistration))
-	http.Handle("/login", redisHandler(handleLogin))
+	http.Handle("/registration", storeHandler(handleRegistration))
+	http.Handle("/login", storeHandler(handleLogin))
 	http.HandleFunc("/logout", handleLogout)
-	http.Handle("/post", redisHandler(handlePost))
+	http.Handle("/post", storeHandler(handlePost))
+	http.Handle("/edit", storeHandler(handleEdit))
+	http.Handle("/delete", storeHandler(handleDelete))
+	http.Handle("/post/comments", storeHandler(handleCommentsOff))
+	http.Handle("/like", storeHandler(handleLike))
+	http.Handle("/comment", storeHandler(handleComment))
+	http.Handle("/comment/delete", storeHandler(handleDeleteComment))
+	http.Handle("/tag/", appHandler(handleTag))
+	http.Handle("/p/", appHandler(handlePermalink))
+	http.Handle("/feed", appHandler(handleFeed))
+	http.Handle("/follow", storeHandler(handleFollow))
+	http.Handle("/block", storeHandler(handleBlock))
+	http.Handle("/mute", storeHandler(handleMute))
 
 	media := http.FileServer(http.Dir(filepath.Join(mediaPath...)))
 	http.Handle("/media/", http.StripPrefix("/media/", media))
@@ -0,0 +1,95 @@
+/*
+Media files of GoPics' posts.
+
+Copyright (c) 2015, Luca Chiricozzi. All rights reserved.
+Released under the MIT License.
+http://opensource.org/licenses/MIT
+*/
+package main
+
+import (
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/nfnt/resize"
+)
+
+// Temporary media files start with a dot, so they are never served and
+// fsck leaves them alone.
+const mediaTempPrefix = ".upload-"
+
+// writeTempJPEG encodes img as a JPEG in a new temporary file in the
+// media directory and flushes it to disk. It returns the path of the
+// file, which is removed if anything fails.
+func writeTempJPEG(img image.Image) (path string, err error) {
+	f, err := ioutil.TempFile(filepath.Join(mediaPath...), mediaTempPrefix)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if err = jpeg.Encode(f, img, nil); err != nil {
+		return "", err
+	}
+	if err = f.Sync(); err != nil {
+		return "", err
+	}
+	if err = f.Close(); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// fitImage resizes img to fit in maxWidth x maxHeight, keeping its
+// ratio.
+func fitImage(src image.Image) image.Image {
+	// Get the ratio d of the image
+	bound := src.Bounds()
+	x, y := bound.Max.X, bound.Max.Y
+	d := float32(x) / float32(y)
+
+	// Check the image sizes
+	if x > maxWidth || y > maxHeight {
+		if x > y {
+			return resize.Resize(uint(maxWidth), uint(1/d*maxWidth),
+				src, resize.Lanczos3)
+		}
+		return resize.Resize(uint(d*maxHeight), uint(maxHeight),
+			src, resize.Lanczos3)
+	}
+	return resize.Resize(uint(x), uint(y), src, resize.Lanczos3)
+}
+
+// removeMedia deletes the media file with the given name, a missing file
+// is not an error.
+func removeMedia(name string) error {
+	err := os.Remove(buildFilePath(mediaPath, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// commitMedia moves the temporary file at tmp to the media file with the
+// given name, making it visible, and flushes the media directory.
+func commitMedia(tmp, name string) error {
+	dir := filepath.Join(mediaPath...)
+	if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		return err
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,859 @@
+/*
+In-memory Store for GoPics.
+
+Copyright (c) 2015, Luca Chiricozzi. All rights reserved.
+Released under the MIT License.
+http://opensource.org/licenses/MIT
+*/
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// sortedSet is a set of members ordered by score, members with the same
+// score are ordered lexicographically, as Redis does.
+type sortedSet []scoredMember
+
+// less reports whether the member at i must stay before the given one.
+func (ss sortedSet) less(i int, m scoredMember) bool {
+	if ss[i].Score != m.Score {
+		return ss[i].Score < m.Score
+	}
+	return ss[i].Member < m.Member
+}
+
+// add inserts m in the set, keeping it sorted, and returns the new set.
+// If a member with the same name already exists, its score is updated.
+func (ss sortedSet) add(m scoredMember) sortedSet {
+	ss = ss.remove(m.Member)
+	i := sort.Search(len(ss), func(i int) bool { return !ss.less(i, m) })
+	ss = append(ss, scoredMember{})
+	copy(ss[i+1:], ss[i:])
+	ss[i] = m
+	return ss
+}
+
+// remove deletes the member with the given name from the set, if any,
+// and returns the new set.
+func (ss sortedSet) remove(member string) sortedSet {
+	for i := range ss {
+		if ss[i].Member == member {
+			return append(ss[:i], ss[i+1:]...)
+		}
+	}
+	return ss
+}
+
+// revPage returns about n members with a score lower than before,
+// starting from the one with the highest score, and the cursor of the
+// next page, see Store.GetTimeline.
+func (ss sortedSet) revPage(before int64, n int) ([]string, int64) {
+	members := []string{}
+	var last int64
+	for i := len(ss) - 1; i >= 0; i-- {
+		m := ss[i]
+		switch {
+		case before > 0 && m.Score >= before:
+			continue
+		case len(members) >= n && m.Score != last:
+			return members, last
+		}
+		members = append(members, m.Member)
+		last = m.Score
+	}
+	return members, 0
+}
+
+// memoryStore is a Store that keeps all its data in the memory of the
+// process. It is safe for concurrent use, but its data are lost when
+// GoPics stops, so it is meant for development and tests.
+type memoryStore struct {
+	mu        sync.RWMutex
+	users     map[string]User                // By folded name
+	emails    map[string]string              // Folded email to folded name
+	posts     map[string]Post                // By name
+	comments  map[string][]Comment           // By post name
+	likes     map[string]map[string]Like     // By post name, then folded name
+	liked     map[string]sortedSet           // Liked posts by folded name
+	mentions  map[string]map[string]Mention  // By post name, then folded name
+	mentioned map[string]sortedSet           // Mentioning posts by folded name
+	tags      map[string]sortedSet           // Posts by folded hashtag
+	following map[string]map[string]Follow   // By folded name, then followed
+	followers map[string]map[string]Follow   // By folded name, then follower
+	blocking  map[string]map[string]Relation // By folded name, then blocked
+	blockers  map[string]map[string]Relation // By folded name, then blocker
+	muting    map[string]map[string]Relation // By folded name, then muted
+	timelines map[string]sortedSet           // By folded name
+	feeds     map[string]sortedSet           // By folded name
+}
+
+// newMemoryStore creates a new empty memoryStore.
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:     make(map[string]User),
+		emails:    make(map[string]string),
+		posts:     make(map[string]Post),
+		comments:  make(map[string][]Comment),
+		likes:     make(map[string]map[string]Like),
+		liked:     make(map[string]sortedSet),
+		mentions:  make(map[string]map[string]Mention),
+		mentioned: make(map[string]sortedSet),
+		tags:      make(map[string]sortedSet),
+		following: make(map[string]map[string]Follow),
+		followers: make(map[string]map[string]Follow),
+		blocking:  make(map[string]map[string]Relation),
+		blockers:  make(map[string]map[string]Relation),
+		muting:    make(map[string]map[string]Relation),
+		timelines: make(map[string]sortedSet),
+		feeds:     make(map[string]sortedSet),
+	}
+}
+
+// GetUser implements Store.
+func (s *memoryStore) GetUser(ctx context.Context, username string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	usr, ok := s.users[foldName(username)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &usr, nil
+}
+
+// GetUserByEmail implements Store.
+func (s *memoryStore) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	usr, ok := s.users[s.emails[foldEmail(email)]]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &usr, nil
+}
+
+// CreateUser implements Store.
+func (s *memoryStore) CreateUser(ctx context.Context, usr *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name, email := foldName(usr.Name), foldEmail(usr.Email)
+	if _, ok := s.users[name]; ok {
+		return ErrUserExists
+	}
+	if _, ok := s.emails[email]; ok {
+		return ErrEmailExists
+	}
+
+	u := *usr
+	u.Password = append([]byte(nil), usr.Password...)
+	u.Posts = nil
+	s.users[name] = u
+	s.emails[email] = name
+	return nil
+}
+
+// GetTimeline implements Store.
+func (s *memoryStore) GetTimeline(ctx context.Context, username string, before int64,
+	n int) ([]Post, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names, next := s.timelines[foldName(username)].revPage(before, n)
+	posts := []Post{}
+	for _, name := range names {
+		posts = append(posts, s.posts[name])
+	}
+	return posts, next, nil
+}
+
+// GetPost implements Store.
+func (s *memoryStore) GetPost(ctx context.Context, name string) (*Post, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.posts[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &p, nil
+}
+
+// AddPost implements Store.
+func (s *memoryStore) AddPost(ctx context.Context, p *Post) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tag(*p, p.Tags)
+	s.posts[p.Name] = *p
+	author := foldName(p.AuthorName)
+	s.timelines[author] = s.timelines[author].add(scoredMember{p.Time, p.Name})
+	for name := range s.followers[author] {
+		s.addToFeed(name, scoredMember{p.Time, p.Name})
+	}
+	return nil
+}
+
+// addToFeed adds m to the feed of the user with the given folded name,
+// dropping the oldest posts beyond feedLen, the caller must hold the
+// lock.
+func (s *memoryStore) addToFeed(name string, m scoredMember) {
+	feed := s.feeds[name].add(m)
+	if len(feed) > feedLen {
+		feed = feed[len(feed)-feedLen:]
+	}
+	s.feeds[name] = feed
+}
+
+// tag moves p from the pages of its hashtags to the pages of the given
+// ones, the caller must hold the lock.
+func (s *memoryStore) tag(p Post, tags []string) {
+	if old, ok := s.posts[p.Name]; ok {
+		for _, tag := range old.Tags {
+			s.tags[tag] = s.tags[tag].remove(p.Name)
+		}
+	}
+	for _, tag := range tags {
+		s.tags[tag] = s.tags[tag].add(scoredMember{p.Time, p.Name})
+	}
+}
+
+// EditPost implements Store.
+func (s *memoryStore) EditPost(ctx context.Context, p *Post, text string,
+	t int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	post, ok := s.posts[p.Name]
+	if !ok {
+		return ErrNotFound
+	}
+	post.edit(text, t)
+	s.tag(post, post.Tags)
+	s.posts[p.Name] = post
+	return nil
+}
+
+// DeletePost implements Store.
+func (s *memoryStore) DeletePost(ctx context.Context, p *Post) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tag(*p, nil)
+	delete(s.posts, p.Name)
+	delete(s.comments, p.Name)
+	for name := range s.likes[p.Name] {
+		s.liked[name] = s.liked[name].remove(p.Name)
+	}
+	delete(s.likes, p.Name)
+	for name := range s.mentions[p.Name] {
+		s.mentioned[name] = s.mentioned[name].remove(p.Name)
+	}
+	delete(s.mentions, p.Name)
+	author := foldName(p.AuthorName)
+	s.timelines[author] = s.timelines[author].remove(p.Name)
+	for name := range s.followers[author] {
+		s.feeds[name] = s.feeds[name].remove(p.Name)
+	}
+	return nil
+}
+
+// GetComments implements Store.
+func (s *memoryStore) GetComments(ctx context.Context,
+	names []string) (map[string][]Comment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	comments := make(map[string][]Comment)
+	for _, name := range names {
+		comments[name] = append([]Comment(nil), s.comments[name]...)
+	}
+	return comments, nil
+}
+
+// AddComment implements Store.
+func (s *memoryStore) AddComment(ctx context.Context, p *Post,
+	c *Comment) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	post, ok := s.posts[p.Name]
+	switch {
+	case !ok:
+		return ErrNotFound
+	case post.NoComments:
+		return ErrCommentsOff
+	}
+
+	if c.Parent != "" {
+		found := false
+		for _, other := range s.comments[p.Name] {
+			found = found || other.ID == c.Parent
+		}
+		if !found {
+			return ErrNotFound
+		}
+	}
+
+	s.comments[p.Name] = append(s.comments[p.Name], *c)
+	return nil
+}
+
+// DeleteComments implements Store.
+func (s *memoryStore) DeleteComments(ctx context.Context, p *Post,
+	ids []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	drop := make(map[string]bool)
+	for _, id := range ids {
+		drop[id] = true
+	}
+	kept := []Comment{}
+	for _, c := range s.comments[p.Name] {
+		if !drop[c.ID] {
+			kept = append(kept, c)
+		}
+	}
+	s.comments[p.Name] = kept
+	return nil
+}
+
+// SetCommentsOff implements Store.
+func (s *memoryStore) SetCommentsOff(ctx context.Context, p *Post,
+	off bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	post, ok := s.posts[p.Name]
+	if !ok {
+		return ErrNotFound
+	}
+	post.NoComments = off
+	s.posts[p.Name] = post
+	return nil
+}
+
+// LikePost implements Store.
+func (s *memoryStore) LikePost(ctx context.Context, p *Post,
+	username string, like bool, t int64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.posts[p.Name]; !ok {
+		return 0, ErrNotFound
+	}
+	s.like(Like{p.Name, username, t}, like)
+	return len(s.likes[p.Name]), nil
+}
+
+// like adds or removes l, the caller must hold the lock.
+func (s *memoryStore) like(l Like, like bool) {
+	name := foldName(l.UserName)
+	if !like {
+		delete(s.likes[l.PostName], name)
+		s.liked[name] = s.liked[name].remove(l.PostName)
+		return
+	}
+
+	if s.likes[l.PostName] == nil {
+		s.likes[l.PostName] = make(map[string]Like)
+	}
+	if _, ok := s.likes[l.PostName][name]; ok {
+		return
+	}
+	s.likes[l.PostName][name] = l
+	s.liked[name] = s.liked[name].add(scoredMember{l.Time, l.PostName})
+}
+
+// GetLikers implements Store.
+func (s *memoryStore) GetLikers(ctx context.Context,
+	names []string) (map[string][]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	likers := make(map[string][]string)
+	for _, name := range names {
+		users := []string{}
+		for _, l := range s.likes[name] {
+			users = append(users, l.UserName)
+		}
+		sort.Strings(users)
+		likers[name] = users
+	}
+	return likers, nil
+}
+
+// GetLikedPosts implements Store.
+func (s *memoryStore) GetLikedPosts(ctx context.Context, username string,
+	before int64, n int) ([]Post, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names, next := s.liked[foldName(username)].revPage(before, n)
+	posts := []Post{}
+	for _, name := range names {
+		if p, ok := s.posts[name]; ok {
+			posts = append(posts, p)
+		}
+	}
+	return posts, next, nil
+}
+
+// AddMentions implements Store.
+func (s *memoryStore) AddMentions(ctx context.Context, p *Post,
+	usernames []string, t int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.posts[p.Name]; !ok {
+		return ErrNotFound
+	}
+	for _, name := range usernames {
+		s.mention(Mention{p.Name, name, t})
+	}
+	return nil
+}
+
+// mention adds m, unless the user is already mentioned in the post, the
+// caller must hold the lock.
+func (s *memoryStore) mention(m Mention) {
+	name := foldName(m.UserName)
+	if s.mentions[m.PostName] == nil {
+		s.mentions[m.PostName] = make(map[string]Mention)
+	}
+	if _, ok := s.mentions[m.PostName][name]; ok {
+		return
+	}
+	s.mentions[m.PostName][name] = m
+	s.mentioned[name] = s.mentioned[name].add(scoredMember{m.Time, m.PostName})
+}
+
+// GetMentioned implements Store.
+func (s *memoryStore) GetMentioned(ctx context.Context,
+	names []string) (map[string][]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	mentioned := make(map[string][]string)
+	for _, name := range names {
+		users := []string{}
+		for _, m := range s.mentions[name] {
+			users = append(users, m.UserName)
+		}
+		sort.Strings(users)
+		mentioned[name] = users
+	}
+	return mentioned, nil
+}
+
+// GetMentionPosts implements Store.
+func (s *memoryStore) GetMentionPosts(ctx context.Context, username string,
+	before int64, n int) ([]Post, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names, next := s.mentioned[foldName(username)].revPage(before, n)
+	posts := []Post{}
+	for _, name := range names {
+		if p, ok := s.posts[name]; ok {
+			posts = append(posts, p)
+		}
+	}
+	return posts, next, nil
+}
+
+// Follow implements Store.
+func (s *memoryStore) Follow(ctx context.Context, username, other string,
+	follow bool, t int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := Follow{foldName(username), foldName(other), t}
+	if _, ok := s.users[f.Followed]; !ok {
+		return ErrNotFound
+	}
+	if _, ok := s.blocking[f.Follower][f.Followed]; ok && follow {
+		return ErrBlocked
+	}
+	if _, ok := s.blocking[f.Followed][f.Follower]; ok && follow {
+		return ErrBlocked
+	}
+	_, ok := s.following[f.Follower][f.Followed]
+	switch {
+	case follow && !ok:
+		s.follow(f)
+		tl := s.timelines[f.Followed]
+		if len(tl) > feedBackfill {
+			tl = tl[len(tl)-feedBackfill:]
+		}
+		for _, m := range tl {
+			s.addToFeed(f.Follower, m)
+		}
+	case !follow && ok:
+		s.unfollow(f.Follower, f.Followed)
+	}
+	return nil
+}
+
+// unfollow removes the follow of followed by follower, both folded, and
+// the posts of followed from the feed of follower. The caller must hold
+// the lock.
+func (s *memoryStore) unfollow(follower, followed string) {
+	if _, ok := s.following[follower][followed]; !ok {
+		return
+	}
+	delete(s.following[follower], followed)
+	delete(s.followers[followed], follower)
+	for _, m := range s.timelines[followed] {
+		s.feeds[follower] = s.feeds[follower].remove(m.Member)
+	}
+}
+
+// follow adds f to the follow graph, the caller must hold the lock.
+func (s *memoryStore) follow(f Follow) {
+	if s.following[f.Follower] == nil {
+		s.following[f.Follower] = make(map[string]Follow)
+	}
+	if s.followers[f.Followed] == nil {
+		s.followers[f.Followed] = make(map[string]Follow)
+	}
+	s.following[f.Follower][f.Followed] = f
+	s.followers[f.Followed][f.Follower] = f
+}
+
+// IsFollowing implements Store.
+func (s *memoryStore) IsFollowing(ctx context.Context, username,
+	other string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.following[foldName(username)][foldName(other)]
+	return ok, nil
+}
+
+// GetFollowCounts implements Store.
+func (s *memoryStore) GetFollowCounts(ctx context.Context,
+	username string) (int, int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name := foldName(username)
+	return len(s.followers[name]), len(s.following[name]), nil
+}
+
+// GetFeed implements Store.
+func (s *memoryStore) GetFeed(ctx context.Context, username string,
+	before int64, n int) ([]Post, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names, next := s.feeds[foldName(username)].revPage(before, n)
+	posts := []Post{}
+	for _, name := range names {
+		if p, ok := s.posts[name]; ok {
+			posts = append(posts, p)
+		}
+	}
+	return posts, next, nil
+}
+
+// Block implements Store.
+func (s *memoryStore) Block(ctx context.Context, username, other string,
+	block bool, t int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := Relation{foldName(username), foldName(other), t}
+	if _, ok := s.users[r.To]; !ok {
+		return ErrNotFound
+	}
+	if !block {
+		delete(s.blocking[r.From], r.To)
+		delete(s.blockers[r.To], r.From)
+		return nil
+	}
+	if _, ok := s.blocking[r.From][r.To]; !ok {
+		s.block(r)
+	}
+	s.unfollow(r.From, r.To)
+	s.unfollow(r.To, r.From)
+	return nil
+}
+
+// block adds the block r, the caller must hold the lock.
+func (s *memoryStore) block(r Relation) {
+	if s.blocking[r.From] == nil {
+		s.blocking[r.From] = make(map[string]Relation)
+	}
+	if s.blockers[r.To] == nil {
+		s.blockers[r.To] = make(map[string]Relation)
+	}
+	s.blocking[r.From][r.To] = r
+	s.blockers[r.To][r.From] = r
+}
+
+// Mute implements Store.
+func (s *memoryStore) Mute(ctx context.Context, username, other string,
+	mute bool, t int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := Relation{foldName(username), foldName(other), t}
+	if _, ok := s.users[r.To]; !ok {
+		return ErrNotFound
+	}
+	if !mute {
+		delete(s.muting[r.From], r.To)
+		return nil
+	}
+	if _, ok := s.muting[r.From][r.To]; !ok {
+		s.mute(r)
+	}
+	return nil
+}
+
+// mute adds the mute r, the caller must hold the lock.
+func (s *memoryStore) mute(r Relation) {
+	if s.muting[r.From] == nil {
+		s.muting[r.From] = make(map[string]Relation)
+	}
+	s.muting[r.From][r.To] = r
+}
+
+// GetBlocks implements Store.
+func (s *memoryStore) GetBlocks(ctx context.Context,
+	username string) (*Blocks, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name := foldName(username)
+	b := newBlocks()
+	for other := range s.blocking[name] {
+		b.Blocking[other] = true
+	}
+	for other := range s.blockers[name] {
+		b.Blockers[other] = true
+	}
+	for other := range s.muting[name] {
+		b.Muting[other] = true
+	}
+	return b, nil
+}
+
+// GetTagPosts implements Store.
+func (s *memoryStore) GetTagPosts(ctx context.Context, tag string,
+	before int64, n int) ([]Post, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names, next := s.tags[tag].revPage(before, n)
+	posts := []Post{}
+	for _, name := range names {
+		if p, ok := s.posts[name]; ok {
+			posts = append(posts, p)
+		}
+	}
+	return posts, next, nil
+}
+
+// Snapshot implements Store.
+func (s *memoryStore) Snapshot(ctx context.Context) (*Snapshot, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snap := &Snapshot{
+		Version:   schemaVersion(),
+		Users:     []User{},
+		Posts:     []Post{},
+		Comments:  []Comment{},
+		Likes:     []Like{},
+		Mentions:  []Mention{},
+		Follows:   []Follow{},
+		Blocks:    []Relation{},
+		Mutes:     []Relation{},
+		Timelines: make(map[string][]scoredMember),
+		Feeds:     make(map[string][]scoredMember),
+	}
+	for _, usr := range s.users {
+		snap.Users = append(snap.Users, usr)
+	}
+	for _, p := range s.posts {
+		snap.Posts = append(snap.Posts, p)
+	}
+	for _, cs := range s.comments {
+		snap.Comments = append(snap.Comments, cs...)
+	}
+	for _, likes := range s.likes {
+		for _, l := range likes {
+			snap.Likes = append(snap.Likes, l)
+		}
+	}
+	for _, mentions := range s.mentions {
+		for _, m := range mentions {
+			snap.Mentions = append(snap.Mentions, m)
+		}
+	}
+	for _, follows := range s.following {
+		for _, f := range follows {
+			snap.Follows = append(snap.Follows, f)
+		}
+	}
+	for _, blocks := range s.blocking {
+		for _, r := range blocks {
+			snap.Blocks = append(snap.Blocks, r)
+		}
+	}
+	for _, mutes := range s.muting {
+		for _, r := range mutes {
+			snap.Mutes = append(snap.Mutes, r)
+		}
+	}
+	for name, tl := range s.timelines {
+		snap.Timelines[name] = append([]scoredMember(nil), tl...)
+	}
+	for name, feed := range s.feeds {
+		snap.Feeds[name] = append([]scoredMember(nil), feed...)
+	}
+	return snap, nil
+}
+
+// Restore implements Store.
+func (s *memoryStore) Restore(ctx context.Context, snap *Snapshot) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, usr := range snap.Users {
+		name := foldName(usr.Name)
+		s.users[name] = usr
+		s.emails[foldEmail(usr.Email)] = name
+	}
+	for _, p := range snap.Posts {
+		s.tag(p, p.Tags)
+		s.posts[p.Name] = p
+	}
+	for _, c := range snap.Comments {
+		cs := s.comments[c.PostName]
+		for i := range cs {
+			if cs[i].ID == c.ID {
+				cs = append(cs[:i], cs[i+1:]...)
+				break
+			}
+		}
+		s.comments[c.PostName] = append(cs, c)
+	}
+	for _, l := range snap.Likes {
+		s.like(l, true)
+	}
+	for _, m := range snap.Mentions {
+		s.mention(m)
+	}
+	for _, f := range snap.Follows {
+		s.follow(f)
+	}
+	for _, r := range snap.Blocks {
+		s.block(r)
+	}
+	for _, r := range snap.Mutes {
+		s.mute(r)
+	}
+	for name, members := range snap.Timelines {
+		for _, m := range members {
+			s.timelines[name] = s.timelines[name].add(m)
+		}
+	}
+	for name, members := range snap.Feeds {
+		for _, m := range members {
+			s.addToFeed(name, m)
+		}
+	}
+	return nil
+}
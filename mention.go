@@ -0,0 +1,71 @@
+/*
+Mentions of GoPics' users in posts and comments.
+
+Copyright (c) 2015, Luca Chiricozzi. All rights reserved.
+Released under the MIT License.
+http://opensource.org/licenses/MIT
+*/
+package main
+
+import (
+	"context"
+
+	"github.com/lucachr/gopics/reutils"
+)
+
+// Max number of users mentioned by a single text.
+const maxMentions = 10
+
+// mentionedUsers returns the names of the users mentioned in text, in
+// order of appearance. Names nobody can register, names of users that
+// do not exist, of users blocked by or blocking the author and the name
+// of the author are left out. Only the first maxMentions names left are
+// looked up, whether the users exist or not, so a text full of made up
+// names costs a bounded number of lookups.
+func mentionedUsers(ctx context.Context, s Store, text,
+	author string) ([]string, error) {
+	locs := reutils.FindMentionsIndex(text)
+	if len(locs) == 0 {
+		return []string{}, nil
+	}
+	blocks, err := s.GetBlocks(ctx, author)
+	if err != nil {
+		return nil, err
+	}
+
+	users, lookups := []string{}, 0
+	seen := map[string]bool{foldName(author): true}
+	for _, loc := range locs {
+		name := text[loc[0]+1 : loc[1]]
+		if seen[foldName(name)] || reservedName(name) ||
+			blocks.blocked(name) {
+			continue
+		}
+		seen[foldName(name)] = true
+		if lookups == maxMentions {
+			break
+		}
+		lookups++
+
+		usr, err := s.GetUser(ctx, name)
+		switch {
+		case err == ErrNotFound:
+			continue
+		case err != nil:
+			return nil, err
+		}
+		users = append(users, usr.Name)
+	}
+	return users, nil
+}
+
+// addMentions records the mentions of users in text, a caption or a
+// comment on p written by author at the Unix time t.
+func addMentions(ctx context.Context, s Store, p *Post, text,
+	author string, t int64) error {
+	users, err := mentionedUsers(ctx, s, text, author)
+	if err != nil || len(users) == 0 {
+		return err
+	}
+	return s.AddMentions(ctx, p, users, t)
+}
@@ -0,0 +1,108 @@
+/*
+Tests of the mentions of GoPics' users.
+
+Copyright (c) 2015, Luca Chiricozzi. All rights reserved.
+Released under the MIT License.
+http://opensource.org/licenses/MIT
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// lookupStore is a Store that counts the calls to GetUser.
+type lookupStore struct {
+	Store
+	lookups int
+}
+
+// GetUser implements Store.
+func (s *lookupStore) GetUser(ctx context.Context,
+	username string) (*User, error) {
+	s.lookups++
+	return s.Store.GetUser(ctx, username)
+}
+
+// TestMentionedUsersLookups checks that a text mentioning many users
+// that do not exist costs at most maxMentions lookups.
+func TestMentionedUsersLookups(t *testing.T) {
+	ctx := context.Background()
+	s := &lookupStore{Store: newMemoryStore()}
+	err := s.CreateUser(ctx, &User{Name: "Alice", Email: "alice@x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for i := 0; i < 10*maxMentions; i++ {
+		names = append(names, "@ghost"+strconv.Itoa(i))
+	}
+	text := strings.Join(append(names, "@Alice"), " ")
+	users, err := mentionedUsers(ctx, s, text, "Bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 0 {
+		t.Errorf("got the mentioned users %v, want none", users)
+	}
+	if s.lookups != maxMentions {
+		t.Errorf("got %d lookups, want %d", s.lookups, maxMentions)
+	}
+}
+
+// mentionsDownStore is a Store that fails to record mentions.
+type mentionsDownStore struct {
+	Store
+}
+
+// AddMentions implements Store.
+func (s mentionsDownStore) AddMentions(ctx context.Context, p *Post,
+	usernames []string, t int64) error {
+	return errors.New("mentions down")
+}
+
+// TestMentionsDown checks that edits and comments are not failed when
+// their mentions cannot be recorded after they are stored.
+func TestMentionsDown(t *testing.T) {
+	ctx := context.Background()
+	s := mentionsDownStore{newMemoryStore()}
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"Alice", "Bob"} {
+		check(s.CreateUser(ctx, &User{Name: name, Email: name + "@x"}))
+	}
+	p := &Post{Name: "p.jpeg", AuthorName: "Alice", Time: 1}
+	check(s.AddPost(ctx, p))
+
+	ae := handleEdit(httptest.NewRecorder(),
+		formRequest("Alice", "/edit", "name=p.jpeg&text=hi+@Bob"), s)
+	if ae != nil {
+		t.Fatalf("edit: got %v", ae.Err)
+	}
+	got, err := s.GetPost(ctx, p.Name)
+	check(err)
+	if got.Text != "hi @Bob" {
+		t.Errorf("got the caption %q, want %q", got.Text, "hi @Bob")
+	}
+
+	ae = handleComment(httptest.NewRecorder(),
+		formRequest("Bob", "/comment", "name=p.jpeg&text=hi+@Alice"), s)
+	if ae != nil {
+		t.Fatalf("comment: got %v", ae.Err)
+	}
+	comments, err := s.GetComments(ctx, []string{p.Name})
+	check(err)
+	if n := len(comments[p.Name]); n != 1 {
+		t.Errorf("got %d comments, want 1", n)
+	}
+}
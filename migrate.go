@@ -0,0 +1,628 @@
+/*
+Versioned data schema and migrations for GoPics.
+
+Copyright (c) 2015, Luca Chiricozzi. All rights reserved.
+Released under the MIT License.
+http://opensource.org/licenses/MIT
+*/
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	bolt "go.etcd.io/bbolt"
+)
+
+// A migration upgrades the data of a Store to its Version, with one
+// function for each persistent backend. Migrations must be idempotent,
+// so a migration stopped halfway can be run again.
+type migration struct {
+	Version int
+	Desc    string
+	Redis   func(conn redis.Conn, ks keyspace) error
+	Bolt    func(tx *bolt.Tx) error
+}
+
+// The migrations, in order. The current schema version is the version of
+// the last one.
+var migrations = []migration{
+	{
+		Version: 1,
+		Desc:    "store the publishing time of posts as Unix time",
+		Redis:   redisMigratePostTime,
+		Bolt:    boltMigratePostTime,
+	},
+	{
+		Version: 2,
+		Desc:    "case fold usernames and index emails",
+		Redis:   redisMigrateFoldNames,
+		Bolt:    boltMigrateFoldNames,
+	},
+	{
+		Version: 3,
+		Desc:    "index the hashtags of captions",
+		Redis:   redisMigrateTags,
+		Bolt:    boltMigrateTags,
+	},
+}
+
+// schemaVersion returns the current version of the data schema.
+func schemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// A migrator is a Store that keeps its data across restarts, so its data
+// may need to be migrated to the current schema.
+type migrator interface {
+	// SchemaVersion returns the schema version of the data in the
+	// Store, without writing anything. An empty Store is at the current
+	// version, data from before the versioning are at version 0.
+	SchemaVersion() (int, error)
+
+	// InitSchema sets the schema version of a Store without any data to
+	// the current version, so it keeps it once data are written. Other
+	// Stores are left as they are.
+	InitSchema() error
+
+	// Migrate runs m and sets the schema version to m.Version.
+	Migrate(m migration) error
+}
+
+// initSchema sets the schema version of s, if s is empty, see
+// migrator.InitSchema. It must run before the first write to a Store.
+func initSchema(s Store) error {
+	if m, ok := s.(migrator); ok {
+		return m.InitSchema()
+	}
+	return nil
+}
+
+// checkSchema returns ErrSchema if the data in s does not use the
+// current schema version.
+func checkSchema(s Store) error {
+	m, ok := s.(migrator)
+	if !ok {
+		return nil
+	}
+
+	v, err := m.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if v != schemaVersion() {
+		return ErrSchema
+	}
+	return nil
+}
+
+// cmdMigrate runs, in order, all the migrations the Store selected by
+// -store still needs.
+func cmdMigrate(args []string) error {
+	s, err := newStore(*storeBackend)
+	if err != nil {
+		return err
+	}
+
+	m, ok := s.(migrator)
+	if !ok {
+		log.Printf("migrate: the %s store has nothing to migrate",
+			*storeBackend)
+		return nil
+	}
+
+	if err = m.InitSchema(); err != nil {
+		return err
+	}
+	v, err := m.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for _, mig := range migrations {
+		if mig.Version <= v {
+			continue
+		}
+
+		log.Printf("migrate: %d, %s", mig.Version, mig.Desc)
+		if err = m.Migrate(mig); err != nil {
+			return err
+		}
+	}
+	log.Printf("migrate: schema at version %d", schemaVersion())
+
+	return nil
+}
+
+// SchemaVersion implements migrator.
+func (s *redisStore) SchemaVersion() (int, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return redisSchemaVersion(conn, s.ks)
+}
+
+// InitSchema implements migrator. The check for data and the write of
+// the version are not atomic, so it must run before GoPics serves
+// requests, see main and cmdMigrate.
+func (s *redisStore) InitSchema() error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := redis.Int(conn.Do("GET", s.ks.schema()))
+	if err != redis.ErrNil {
+		return err
+	}
+	data, err := redisHasData(conn, s.ks)
+	if err != nil || data {
+		return err
+	}
+	_, err = conn.Do("SETNX", s.ks.schema(), schemaVersion())
+	return err
+}
+
+// redisSchemaVersion returns the schema version of the data in Redis.
+// Data from before the versioning have no version key, they are at
+// version 0, a keyspace without any data is at the current version.
+func redisSchemaVersion(conn redis.Conn, ks keyspace) (int, error) {
+	v, err := redis.Int(conn.Do("GET", ks.schema()))
+	if err != redis.ErrNil {
+		return v, err
+	}
+
+	data, err := redisHasData(conn, ks)
+	if err != nil || data {
+		return 0, err
+	}
+	return schemaVersion(), nil
+}
+
+// The tags of the keys holding GoPics' data, any version.
+var redisDataTags = []string{userTag, userTimeline, postTag, emailTag,
+	commentsTag, likesTag, likedTag, tagTag, mentionsTag, mentionedTag,
+	followingTag, followersTag, feedTag, blockingTag, blockersTag,
+	mutingTag}
+
+// redisHasData reports whether there is any key with GoPics' data in
+// the keyspace. Keys of other services sharing the keyspace, like the
+// empty one, are ignored.
+func redisHasData(conn redis.Conn, ks keyspace) (bool, error) {
+	cursor := 0
+	for {
+		val, err := redis.Values(conn.Do("SCAN", cursor, "MATCH",
+			ks.key("", "*"), "COUNT", 1000))
+		if err != nil {
+			return false, err
+		}
+
+		var batch []string
+		if _, err = redis.Scan(val, &cursor, &batch); err != nil {
+			return false, err
+		}
+		for _, k := range batch {
+			for _, tag := range redisDataTags {
+				if strings.HasPrefix(k, ks.key(tag, "")) {
+					return true, nil
+				}
+			}
+		}
+
+		if cursor == 0 {
+			return false, nil
+		}
+	}
+}
+
+// Migrate implements migrator.
+func (s *redisStore) Migrate(m migration) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	if err := m.Redis(conn, s.ks); err != nil {
+		return err
+	}
+
+	_, err := conn.Do("SET", s.ks.schema(), m.Version)
+	return err
+}
+
+// SchemaVersion implements migrator.
+func (s *boltStore) SchemaVersion() (int, error) {
+	v := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(boltMeta).Get(boltSchemaKey); data != nil {
+			var err error
+			v, err = strconv.Atoi(string(data))
+			return err
+		}
+		if !boltHasData(tx) {
+			v = schemaVersion()
+		}
+		return nil
+	})
+	return v, err
+}
+
+// InitSchema implements migrator.
+func (s *boltStore) InitSchema() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltMeta).Get(boltSchemaKey) != nil || boltHasData(tx) {
+			return nil
+		}
+		return boltSetSchemaVersion(tx, schemaVersion())
+	})
+}
+
+// boltHasData reports whether any bucket but meta holds a key.
+func boltHasData(tx *bolt.Tx) bool {
+	found := false
+	tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		if string(name) == string(boltMeta) {
+			return nil
+		}
+		if k, _ := b.Cursor().First(); k != nil {
+			found = true
+		}
+		return nil
+	})
+	return found
+}
+
+// Migrate implements migrator. A bolt migration and the update of the
+// version run in the same transaction.
+func (s *boltStore) Migrate(m migration) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := m.Bolt(tx); err != nil {
+			return err
+		}
+		return boltSetSchemaVersion(tx, m.Version)
+	})
+}
+
+// boltSetSchemaVersion sets the schema version of the bolt database.
+func boltSetSchemaVersion(tx *bolt.Tx, v int) error {
+	return tx.Bucket(boltMeta).Put(boltSchemaKey, []byte(strconv.Itoa(v)))
+}
+
+// parsePostTime returns the Unix time of the post published at score, or
+// at the time displayed in old, for posts missing from their timeline.
+// Versions before 1 only stored the minutes, in the local time zone.
+func parsePostTime(score int64, old string) (int64, error) {
+	if score > 0 {
+		return score, nil
+	}
+
+	t, err := time.ParseInLocation(timeLayout, old, time.Local)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
+
+// redisMigratePostTime replaces the display time of every post with its
+// Unix time, taken from its score in the author's timeline.
+func redisMigratePostTime(conn redis.Conn, ks keyspace) error {
+	names, err := ks.scan(conn, postTag)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		k := ks.post(name)
+		val, err := redis.Strings(conn.Do("HMGET", k, "time", "author_name"))
+		if err != nil {
+			return err
+		}
+
+		// Already migrated
+		if _, err = strconv.ParseInt(val[0], 10, 64); err == nil {
+			continue
+		}
+
+		score, err := redis.Int64(conn.Do("ZSCORE",
+			ks.key(userTimeline, val[1]), name))
+		if err != nil && err != redis.ErrNil {
+			return err
+		}
+
+		t, err := parsePostTime(score, val[0])
+		if err != nil {
+			return err
+		}
+		if _, err = conn.Do("HSET", k, "time", t); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// boltMigratePostTime replaces the display time of every post with its
+// Unix time, taken from its score in the author's timeline.
+func boltMigratePostTime(tx *bolt.Tx) error {
+	// A bucket cannot change while ForEach walks it, so collect the
+	// migrated posts first.
+	pb := tx.Bucket(boltPosts)
+	migrated := make(map[string]map[string]interface{})
+	err := pb.ForEach(func(k, v []byte) error {
+		var old struct {
+			AuthorName string
+			Time       interface{}
+		}
+		if err := json.Unmarshal(v, &old); err != nil {
+			return err
+		}
+
+		// Already migrated
+		display, ok := old.Time.(string)
+		if !ok {
+			return nil
+		}
+
+		var score int64
+		if tl := tx.Bucket(boltTimelines).Bucket([]byte(old.AuthorName)); tl != nil {
+			tl.ForEach(func(tk, _ []byte) error {
+				if string(tk[8:]) == string(k) {
+					score = boltScore(tk)
+				}
+				return nil
+			})
+		}
+
+		t, err := parsePostTime(score, display)
+		if err != nil {
+			return err
+		}
+
+		// Keep the other fields as they are.
+		var p map[string]interface{}
+		if err = json.Unmarshal(v, &p); err != nil {
+			return err
+		}
+		p["Time"] = t
+		migrated[string(k)] = p
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for name, p := range migrated {
+		if err = boltPutJSON(pb, name, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reportCollisions logs the names that are equal once case folded, and
+// returns ErrNameCollision if there is any.
+func reportCollisions(names []string) error {
+	folded := make(map[string][]string)
+	for _, name := range names {
+		f := foldName(name)
+		folded[f] = append(folded[f], name)
+	}
+
+	var err error
+	for f, names := range folded {
+		if len(names) > 1 {
+			log.Printf("migrate: users %s are all %q once case folded",
+				strings.Join(names, ", "), f)
+			err = ErrNameCollision
+		}
+	}
+	return err
+}
+
+// reportEmailCollision logs that username cannot be found by email,
+// because owner has the same email.
+func reportEmailCollision(username, owner, email string) {
+	log.Printf("migrate: %s has the same email as %s, %s, only %s can "+
+		"be found by email", username, owner, email, owner)
+}
+
+// redisMigrateFoldNames moves the users and their timelines to keys with
+// the folded username and builds the email index. If some usernames
+// collide once folded, it reports them and changes nothing. Users sharing
+// an email are reported, the index keeps the first one.
+func redisMigrateFoldNames(conn redis.Conn, ks keyspace) error {
+	names, err := ks.scan(conn, userTag)
+	if err != nil {
+		return err
+	}
+	if err = reportCollisions(names); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		f := foldName(name)
+
+		// Move the timeline before the user, so a migration stopped
+		// halfway finds the user under its old name.
+		if name != f {
+			tl, err := redis.Bool(conn.Do("EXISTS",
+				ks.key(userTimeline, name)))
+			if err != nil {
+				return err
+			}
+			if tl {
+				_, err = conn.Do("RENAME", ks.key(userTimeline, name),
+					ks.timeline(f))
+				if err != nil {
+					return err
+				}
+			}
+			_, err = conn.Do("RENAME", ks.key(userTag, name), ks.user(f))
+			if err != nil {
+				return err
+			}
+		}
+
+		email, err := redis.String(conn.Do("HGET", ks.user(f), "email"))
+		if err != nil {
+			return err
+		}
+		email = foldEmail(email)
+		if _, err = conn.Do("HSET", ks.user(f), "email", email); err != nil {
+			return err
+		}
+
+		indexed, err := redis.Bool(conn.Do("SETNX", ks.email(email), f))
+		if err != nil {
+			return err
+		}
+		if indexed {
+			continue
+		}
+		owner, err := redis.String(conn.Do("GET", ks.email(email)))
+		if err != nil {
+			return err
+		}
+		if owner != f {
+			reportEmailCollision(f, owner, email)
+		}
+	}
+
+	return nil
+}
+
+// boltMigrateFoldNames moves the users and their timelines to keys with
+// the folded username and builds the email index. If some usernames
+// collide once folded, it reports them and changes nothing. Users sharing
+// an email are reported, the index keeps the first one.
+func boltMigrateFoldNames(tx *bolt.Tx) error {
+	users, timelines := tx.Bucket(boltUsers), tx.Bucket(boltTimelines)
+
+	names := []string{}
+	err := users.ForEach(func(k, _ []byte) error {
+		names = append(names, string(k))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err = reportCollisions(names); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		usr := new(User)
+		if err = boltGetJSON(users, name, usr); err != nil {
+			return err
+		}
+		usr.Email = foldEmail(usr.Email)
+
+		f := foldName(name)
+		if name != f {
+			if err = users.Delete([]byte(name)); err != nil {
+				return err
+			}
+			if err = boltMoveBucket(timelines, name, f); err != nil {
+				return err
+			}
+		}
+		if err = boltPutJSON(users, f, usr); err != nil {
+			return err
+		}
+
+		emails := tx.Bucket(boltEmails)
+		owner := emails.Get([]byte(usr.Email))
+		switch {
+		case owner == nil:
+			err = emails.Put([]byte(usr.Email), []byte(f))
+			if err != nil {
+				return err
+			}
+		case string(owner) != f:
+			reportEmailCollision(f, string(owner), usr.Email)
+		}
+	}
+
+	return nil
+}
+
+// boltMoveBucket moves the keys of the nested bucket from to the nested
+// bucket to, and deletes from.
+func boltMoveBucket(b *bolt.Bucket, from, to string) error {
+	src := b.Bucket([]byte(from))
+	if src == nil {
+		return nil
+	}
+
+	dst, err := b.CreateBucketIfNotExists([]byte(to))
+	if err != nil {
+		return err
+	}
+	err = src.ForEach(func(k, v []byte) error {
+		return dst.Put(k, v)
+	})
+	if err != nil {
+		return err
+	}
+	return b.DeleteBucket([]byte(from))
+}
+
+// redisMigrateTags stores the hashtags of every post and adds the post to
+// the sets of its hashtags.
+func redisMigrateTags(conn redis.Conn, ks keyspace) error {
+	names, err := ks.scan(conn, postTag)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		k := ks.post(name)
+		val, err := redis.Strings(conn.Do("HMGET", k, "text", "time"))
+		if err != nil {
+			return err
+		}
+
+		tags := postTags(val[0])
+		if _, err = conn.Do("HSET", k, "tags", tags.RedisArg()); err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			if _, err = conn.Do("ZADD", ks.tag(tag), val[1], name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// boltMigrateTags stores the hashtags of every post and adds the post to
+// the buckets of its hashtags.
+func boltMigrateTags(tx *bolt.Tx) error {
+	// A bucket cannot change while ForEach walks it, so collect the
+	// posts first.
+	pb := tx.Bucket(boltPosts)
+	posts := []Post{}
+	err := pb.ForEach(func(k, v []byte) error {
+		p := Post{}
+		if err := json.Unmarshal(v, &p); err != nil {
+			return err
+		}
+		posts = append(posts, p)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, p := range posts {
+		p.Tags = postTags(p.Text)
+		if err = boltTag(tx, &p, p.Tags); err != nil {
+			return err
+		}
+		if err = boltPutJSON(pb, p.Name, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -13,4 +13,14 @@ type Page struct {
 	User       *User
 	LoggedUser string // Username of the logged user
 	ValError   string // Validation error message
+	Next       int64  // Cursor of the next page of posts, if any
+	Tab        string // Tab of a profile, "" for posts or "likes"
+	Tag        string // Folded hashtag of a tag page
+	Posts      []Post // Posts shown in the page
+	Followers  int    // Number of followers of User
+	Following  int    // Number of users followed by User
+	Followed   bool   // The logged user follows User
+	Blocked    bool   // The logged user blocks User
+	BlockedBy  bool   // User blocks the logged user
+	Muted      bool   // The logged user mutes User
 }
@@ -7,11 +7,212 @@ http://opensource.org/licenses/MIT
 */
 package main
 
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/lucachr/gopics/reutils"
+)
+
+const (
+	// Number of earlier captions kept in the history of a post.
+	postHistoryLen = 5
+
+	// Max number of hashtags of a post that are indexed.
+	maxPostTags = 30
+
+	// Max length of the caption of a post, in characters.
+	maxCaptionLen = 2000
+)
+
 // An user's post
 type Post struct {
-	AuthorName   string `redis:"author_name"`
-	AuthorPicURL string `redis:"author_pic_url"`
-	Name         string `redis:"name"`
-	Text         string `redis:"text"`
-	Time         string `redis:"time"`
+	AuthorName   string         `redis:"author_name"`
+	AuthorPicURL string         `redis:"author_pic_url"`
+	Name         string         `redis:"name"`
+	Text         string         `redis:"text"`
+	Time         int64          `redis:"time"`    // Unix time of publishing
+	Edited       int64          `redis:"edited"`  // Unix time of the last edit, if any
+	History      captionHistory `redis:"history"` // Earlier captions, newest first
+	Images       stringList     `redis:"images"`  // Media files, in order
+	Tags         stringList     `redis:"tags"`    // Folded hashtags of Text
+	NoComments   bool           `redis:"no_comments"`
+
+	// Comments in reading order, users who like the post and whether
+	// the logged user is one of them, users mentioned in the post or in
+	// its comments, only set for display.
+	Comments  []Comment `redis:"-" json:"-"`
+	LikedBy   []string  `redis:"-" json:"-"`
+	Liked     bool      `redis:"-" json:"-"`
+	Mentioned []string  `redis:"-" json:"-"`
+}
+
+// Media returns the names of the media files of the post, in order.
+// Posts published before carousels have a single media file named as
+// the post.
+func (p Post) Media() []string {
+	if len(p.Images) == 0 {
+		return []string{p.Name}
+	}
+	return p.Images
+}
+
+// stringList is a list of strings, like the names of the media files of
+// a post, stored in Redis as a JSON field of the post hash.
+type stringList []string
+
+// RedisArg implements redis.Argument.
+func (l stringList) RedisArg() interface{} {
+	return redisJSON(l, len(l) == 0)
+}
+
+// RedisScan implements redis.Scanner.
+func (l *stringList) RedisScan(src interface{}) error {
+	return redisScanJSON(src, l)
+}
+
+// A Caption is an earlier version of the text of a post.
+type Caption struct {
+	Text string
+	Time int64 // Unix time since the text was shown
+}
+
+// captionHistory is a list of captions, stored in Redis as a JSON
+// field of the post hash.
+type captionHistory []Caption
+
+// RedisArg implements redis.Argument.
+func (h captionHistory) RedisArg() interface{} {
+	return redisJSON(h, len(h) == 0)
+}
+
+// RedisScan implements redis.Scanner.
+func (h *captionHistory) RedisScan(src interface{}) error {
+	return redisScanJSON(src, h)
+}
+
+// edit sets the text of the post, edited at the Unix time t, and puts
+// the previous text at the top of its history.
+func (p *Post) edit(text string, t int64) {
+	since := p.Edited
+	if since == 0 {
+		since = p.Time
+	}
+	p.History = append(captionHistory{{p.Text, since}}, p.History...)
+	if len(p.History) > postHistoryLen {
+		p.History = p.History[:postHistoryLen]
+	}
+	p.Text = text
+	p.Tags = postTags(text)
+	p.Edited = t
+}
+
+// postTags returns the folded hashtags in the text of a post, without
+// the # and without duplicates, in order of appearance.
+func postTags(text string) stringList {
+	tags := stringList{}
+	seen := make(map[string]bool)
+	for _, loc := range reutils.FindTagsIndex(text) {
+		tag := foldTag(text[loc[0]+1 : loc[1]])
+		if !seen[tag] && len(tags) < maxPostTags {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// foldTag returns the case folded form of a hashtag, posts are indexed
+// by their folded hashtags.
+func foldTag(tag string) string {
+	return fold(tag)
+}
+
+// Caption returns the text of the post as HTML, with its hashtags linked
+// to their pages and its mentions linked to the profiles of the users.
+func (p Post) Caption() template.HTML {
+	return p.linkText(p.Text, true)
+}
+
+// CommentText returns the text of a comment on the post as HTML, with
+// its mentions linked to the profiles of the users.
+func (p Post) CommentText(text string) template.HTML {
+	return p.linkText(text, false)
+}
+
+// linkText returns text as HTML, with the mentions of the users in
+// p.Mentioned linked to their profiles and, if tags is true, with the
+// hashtags linked to their pages. Other mentions stay plain text.
+func (p Post) linkText(text string, tags bool) template.HTML {
+	mentioned := make(map[string]bool)
+	for _, name := range p.Mentioned {
+		mentioned[foldName(name)] = true
+	}
+
+	links := [][]int{}
+	if tags {
+		links = reutils.FindTagsIndex(text)
+	}
+	for _, loc := range reutils.FindMentionsIndex(text) {
+		if mentioned[foldName(text[loc[0]+1:loc[1]])] {
+			links = append(links, loc)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i][0] < links[j][0] })
+
+	var buf bytes.Buffer
+	last := 0
+	for _, loc := range links {
+		word := text[loc[0]:loc[1]]
+		href := "/" + url.PathEscape(word[1:])
+		if word[0] == '#' {
+			href = "/tag/" + url.PathEscape(foldTag(word[1:]))
+		}
+		buf.WriteString(template.HTMLEscapeString(text[last:loc[0]]))
+		fmt.Fprintf(&buf, `<a href="%s">%s</a>`,
+			template.HTMLEscapeString(href), template.HTMLEscapeString(word))
+		last = loc[1]
+	}
+	buf.WriteString(template.HTMLEscapeString(text[last:]))
+	return template.HTML(buf.String())
+}
+
+// existingPosts returns the posts that are not empty, stores return
+// deleted posts empty.
+func existingPosts(posts []Post) []Post {
+	found := []Post{}
+	for _, p := range posts {
+		if p.Name != "" {
+			found = append(found, p)
+		}
+	}
+	return found
+}
+
+// FormatTime returns the publishing time of the post, formatted for
+// display.
+func (p Post) FormatTime() string {
+	return time.Unix(p.Time, 0).Format(timeLayout)
+}
+
+// ISOTime returns the publishing time of the post in RFC 3339 format, for
+// the datetime attribute of the HTML time element.
+func (p Post) ISOTime() string {
+	return time.Unix(p.Time, 0).Format(time.RFC3339)
+}
+
+// FormatEdited returns the time of the last edit of the post, formatted
+// for display.
+func (p Post) FormatEdited() string {
+	return time.Unix(p.Edited, 0).Format(timeLayout)
+}
+
+// ISOEdited returns the time of the last edit of the post in RFC 3339
+// format.
+func (p Post) ISOEdited() string {
+	return time.Unix(p.Edited, 0).Format(time.RFC3339)
 }
@@ -0,0 +1,23 @@
+/*
+Tests of the posts of GoPics.
+
+Copyright (c) 2015, Luca Chiricozzi. All rights reserved.
+Released under the MIT License.
+http://opensource.org/licenses/MIT
+*/
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestPostTags checks that hashtags equal under Unicode case folding are
+// indexed once.
+func TestPostTags(t *testing.T) {
+	got := postTags("#Straße #STRASSE #ΟΔΟΣ #οδος #Sun")
+	want := stringList{"strasse", "οδοσ", "sun"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -8,6 +8,11 @@ http://opensource.org/licenses/MIT
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"log"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
@@ -16,79 +21,1833 @@ import (
 const (
 	redisMaxIdle     = 3
 	redisDefaultAddr = ":6379"
+
+	// Followers whose feeds are changed by a single script call, see
+	// redisFanOut.
+	redisFanOutBatch = 500
+)
+
+var (
+	redisIdleTimeout = 240 * time.Second
+	redisPingAfter   = time.Minute // Idle time before a PING on borrow
+
+	// Time to read the replies left unread when a context is done,
+	// before the connection is dropped.
+	redisDrainTimeout = 100 * time.Millisecond
+
+	// Time runFanOut waits for a fan-out, and waits after an error.
+	redisFanOutWait = 5 * time.Second
 )
 
-var redisIdleTimeout = 240 * time.Second
+// redisConfig holds the options of the connections to Redis.
+type redisConfig struct {
+	Addr          string
+	Password      string
+	DB            int
+	TLS           bool
+	TLSSkipVerify bool
+	DialTimeout   time.Duration
+	ReadTimeout   time.Duration
+	WriteTimeout  time.Duration
+	MaxActive     int  // Max open connections, 0 for no limit
+	Wait          bool // Wait for a connection when MaxActive are open
+}
+
+// redisFlagsConfig returns the redisConfig set by the command line
+// flags.
+func redisFlagsConfig() redisConfig {
+	return redisConfig{
+		Addr:          *redisServer,
+		Password:      *redisPassword,
+		DB:            *redisDB,
+		TLS:           *redisTLS,
+		TLSSkipVerify: *redisTLSSkipVerify,
+		DialTimeout:   *redisDialTimeout,
+		ReadTimeout:   *redisReadTimeout,
+		WriteTimeout:  *redisWriteTimeout,
+		MaxActive:     *redisMaxActive,
+		Wait:          *redisWait,
+	}
+}
 
 // newPool creates a new connections pool for concurrent access
 // to Redis.
-func newPool(server string) *redis.Pool {
+func newPool(cfg redisConfig) *redis.Pool {
 	return &redis.Pool{
 		MaxIdle:     redisMaxIdle,
+		MaxActive:   cfg.MaxActive,
+		Wait:        cfg.Wait,
 		IdleTimeout: redisIdleTimeout,
 		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", server)
+			c, err := redis.Dial("tcp", cfg.Addr,
+				redis.DialPassword(cfg.Password),
+				redis.DialDatabase(cfg.DB),
+				redis.DialUseTLS(cfg.TLS),
+				redis.DialTLSSkipVerify(cfg.TLSSkipVerify),
+				redis.DialConnectTimeout(cfg.DialTimeout),
+				redis.DialReadTimeout(cfg.ReadTimeout),
+				redis.DialWriteTimeout(cfg.WriteTimeout),
+			)
 			if err != nil {
 				return nil, err
 			}
 			return c, err
 		},
+		// Only check the connections idle for a while, the others
+		// fail on their first command anyway.
 		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < redisPingAfter {
+				return nil
+			}
 			_, err := c.Do("PING")
 			return err
 		},
 	}
 }
 
-// redisFlat flatens a struct for Redis HMSET
-func redisFlat(key string, value interface{}) redis.Args {
-	return redis.Args{}.Add(key).AddFlat(value)
+// A keyspace builds the Redis keys of GoPics. All the keys start with
+// the keyspace itself, a namespace that lets GoPics share a Redis
+// instance with other services. The empty keyspace is the one of
+// GoPics before namespacing.
+type keyspace string
+
+// key returns the key with the given tag and id.
+func (ks keyspace) key(tag, id string) string {
+	return string(ks) + tag + id
 }
 
-// redisGetUser search for an user with the given username,
-// it returns the user data if the user is found, otherwise,
-// it returns a redis.ErrNil.
-func redisGetUser(conn redis.Conn, username string) (*User, error) {
-	val, err := redis.Values(conn.Do("HGETALL", userTag+username))
+// user returns the key of the hash of the given user.
+func (ks keyspace) user(username string) string {
+	return ks.key(userTag, foldName(username))
+}
+
+// timeline returns the key of the timeline of the given user.
+func (ks keyspace) timeline(username string) string {
+	return ks.key(userTimeline, foldName(username))
+}
+
+// email returns the key of the email index entry for email, it holds
+// the folded name of the user with that email.
+func (ks keyspace) email(email string) string {
+	return ks.key(emailTag, foldEmail(email))
+}
+
+// post returns the key of the hash of the post with the given name.
+func (ks keyspace) post(name string) string {
+	return ks.key(postTag, name)
+}
+
+// comments returns the key of the hash of the comments on the post with
+// the given name, it maps comment IDs to comments encoded as JSON.
+func (ks keyspace) comments(name string) string {
+	return ks.key(commentsTag, name)
+}
+
+// likes returns the key of the hash of the likes of the post with the
+// given name, it maps folded names to likes encoded as JSON.
+func (ks keyspace) likes(name string) string {
+	return ks.key(likesTag, name)
+}
+
+// liked returns the key of the sorted set of the posts liked by the
+// given user, scored by the time of the like.
+func (ks keyspace) liked(username string) string {
+	return ks.key(likedTag, foldName(username))
+}
+
+// mentions returns the key of the hash of the mentions in the post with
+// the given name, it maps folded names to mentions encoded as JSON.
+func (ks keyspace) mentions(name string) string {
+	return ks.key(mentionsTag, name)
+}
+
+// mentioned returns the key of the sorted set of the posts that mention
+// the given user, scored by the time of the mention.
+func (ks keyspace) mentioned(username string) string {
+	return ks.key(mentionedTag, foldName(username))
+}
+
+// following returns the key of the sorted set of the folded names of
+// the users followed by the given user, scored by the time of the
+// follow.
+func (ks keyspace) following(username string) string {
+	return ks.key(followingTag, foldName(username))
+}
+
+// followers returns the key of the sorted set of the folded names of
+// the followers of the given user, scored by the time of the follow.
+func (ks keyspace) followers(username string) string {
+	return ks.key(followersTag, foldName(username))
+}
+
+// blocking returns the key of the sorted set of the folded names of the
+// users blocked by the given user, scored by the time of the block.
+func (ks keyspace) blocking(username string) string {
+	return ks.key(blockingTag, foldName(username))
+}
+
+// blockers returns the key of the sorted set of the folded names of the
+// users who block the given user, scored by the time of the block.
+func (ks keyspace) blockers(username string) string {
+	return ks.key(blockersTag, foldName(username))
+}
+
+// muting returns the key of the sorted set of the folded names of the
+// users muted by the given user, scored by the time of the mute.
+func (ks keyspace) muting(username string) string {
+	return ks.key(mutingTag, foldName(username))
+}
+
+// feed returns the key of the feed of the given user, a sorted set of
+// posts scored by publishing time.
+func (ks keyspace) feed(username string) string {
+	return ks.key(feedTag, foldName(username))
+}
+
+// tag returns the key of the sorted set of the posts with the given
+// folded hashtag, scored by publishing time.
+func (ks keyspace) tag(tag string) string {
+	return ks.key(tagTag, tag)
+}
+
+// fanOutQueue returns the key of the list of the queued fan-outs, as
+// JSON, the oldest last.
+func (ks keyspace) fanOutQueue() string {
+	return ks.key(fanOutQueueKey, "")
+}
+
+// fanOutRunning returns the key of the list of the fan-outs running, as
+// JSON.
+func (ks keyspace) fanOutRunning() string {
+	return ks.key(fanOutRunningKey, "")
+}
+
+// schema returns the key of the schema version.
+func (ks keyspace) schema() string {
+	return ks.key(schemaKey, "")
+}
+
+// scan returns the ids of all the keys with the given tag, see
+// redisKeys.
+func (ks keyspace) scan(conn redis.Conn, tag string) ([]string, error) {
+	keys, err := redisKeys(conn, ks.key(tag, "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, k := range keys {
+		ids = append(ids, k[len(ks.key(tag, "")):])
+	}
+	return ids, nil
+}
+
+// redisStore is a Store backed by a Redis connections pool.
+type redisStore struct {
+	pool *redis.Pool
+	ks   keyspace
+}
+
+// newRedisStore creates a new Store that keeps its data in the Redis
+// instances reachable through pool, under the given keyspace.
+func newRedisStore(pool *redis.Pool, ks keyspace) *redisStore {
+	return &redisStore{pool: pool, ks: ks}
+}
+
+// conn gets a connection from the pool, waiting for it no longer than
+// ctx allows. Commands sent on the connection are bound to ctx too.
+func (s *redisStore) conn(ctx context.Context) (redis.Conn, error) {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ctxConn{conn, ctx}, nil
+}
+
+// ctxConn is a Redis connection that stops waiting for replies when its
+// context is done.
+type ctxConn struct {
+	redis.Conn
+	ctx context.Context
+}
+
+// Do sends a command and waits for its reply, until the deadline of the
+// context at most.
+func (c ctxConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	deadline, ok := c.ctx.Deadline()
+	if !ok {
+		return c.Conn.Do(cmd, args...)
+	}
+	return redis.DoWithTimeout(c.Conn, time.Until(deadline), cmd, args...)
+}
+
+// Receive waits for a reply, until the deadline of the context at most.
+func (c ctxConn) Receive() (interface{}, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	deadline, ok := c.ctx.Deadline()
+	if !ok {
+		return c.Conn.Receive()
+	}
+	return redis.ReceiveWithTimeout(c.Conn, time.Until(deadline))
+}
+
+// Close returns the connection to the pool. When the context is done,
+// replies may be left unread: they are read for redisDrainTimeout at
+// most, then the connection is closed instead, so a slow server never
+// blocks Close nor leaves stale replies in the pool.
+func (c ctxConn) Close() error {
+	if c.ctx.Err() != nil {
+		redis.DoWithTimeout(c.Conn, redisDrainTimeout, "")
+	}
+	return c.Conn.Close()
+}
+
+// GetUser implements Store.
+func (s *redisStore) GetUser(ctx context.Context, username string) (*User, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return redisGetUser(conn, s.ks, username)
+}
+
+// GetUserByEmail implements Store.
+func (s *redisStore) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	username, err := redis.String(conn.Do("GET", s.ks.email(email)))
+	if err == redis.ErrNil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return redisGetUser(conn, s.ks, username)
+}
+
+// redisCreateUser sets the fields of the user hash at KEYS[1] to ARGV[2:]
+// and the email index at KEYS[2] to ARGV[1], only if neither exists. It
+// returns 1 if the user is created, 0 if the name is taken and -1 if the
+// email is taken.
+var redisCreateUser = redis.NewScript(2, `
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+if redis.call("EXISTS", KEYS[2]) == 1 then
+	return -1
+end
+redis.call("SET", KEYS[2], ARGV[1])
+redis.call("HMSET", KEYS[1], unpack(ARGV, 2))
+return 1
+`)
+
+// CreateUser implements Store.
+func (s *redisStore) CreateUser(ctx context.Context, usr *User) error {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	args := redis.Args{}.Add(s.ks.user(usr.Name), s.ks.email(usr.Email))
+	args = args.Add(foldName(usr.Name)).AddFlat(usr)
+	created, err := redis.Int(redisCreateUser.Do(conn, args...))
+	switch {
+	case err != nil:
+		return err
+	case created == 0:
+		return ErrUserExists
+	case created == -1:
+		return ErrEmailExists
+	}
+	return nil
+}
+
+// GetTimeline implements Store.
+func (s *redisStore) GetTimeline(ctx context.Context, username string, before int64,
+	n int) ([]Post, int64, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	names, next, err := redisRevPage(conn, s.ks.timeline(username),
+		before, n)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	posts, err := redisGetPosts(conn, s.ks, names)
+	if err != nil {
+		return nil, 0, err
+	}
+	return posts, next, nil
+}
+
+// GetPost implements Store.
+func (s *redisStore) GetPost(ctx context.Context, name string) (*Post, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	val, err := redis.Values(conn.Do("HGETALL", s.ks.post(name)))
 	switch {
 	case err != nil:
 		return nil, err
 	case len(val) == 0:
-		return nil, redis.ErrNil
+		return nil, ErrNotFound
 	}
 
-	usr := new(User)
-	err = redis.ScanStruct(val, usr)
-	if err != nil {
+	p := new(Post)
+	if err = redis.ScanStruct(val, p); err != nil {
 		return nil, err
 	}
+	return p, nil
+}
+
+// AddPost implements Store.
+func (s *redisStore) AddPost(ctx context.Context, p *Post) error {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
 
-	return usr, nil
+	job, err := json.Marshal(fanOut{foldName(p.AuthorName), p.Name, p.Time,
+		false})
+	if err != nil {
+		return err
+	}
+
+	// Create the post and add it to the author's timeline, in a single
+	// round trip. The feeds of the followers can be many, they are
+	// filled in the background, see runFanOut.
+	conn.Send("MULTI")
+	conn.Send("HMSET", redisFlat(s.ks.post(p.Name), p)...)
+	conn.Send("ZADD", s.ks.timeline(p.AuthorName), p.Time, p.Name)
+	for _, tag := range p.Tags {
+		conn.Send("ZADD", s.ks.tag(tag), p.Time, p.Name)
+	}
+	conn.Send("LPUSH", s.ks.fanOutQueue(), job)
+	_, err = conn.Do("EXEC")
+	return err
 }
 
-// redisGetPosts return a list of the latest one hundred posts in postSet.
-// Posts are sorted by publishing date, starting from the latest one.
-func redisGetPosts(conn redis.Conn, postSet string) ([]Post, error) {
-	postNames, err := redis.Strings(conn.Do("ZREVRANGE", postSet, 0, 100))
+// redisEditPost sets the text of the post hash at KEYS[1] to ARGV[1] and
+// its edit time to ARGV[2], putting the previous text at the top of its
+// JSON history, which keeps at most ARGV[3] captions. It also sets its
+// JSON hashtags to ARGV[7], moving the post ARGV[5] from the sets of its
+// old hashtags, the ARGV[6] keys after KEYS[1], to the sets at the keys
+// that follow. It returns 0 if the post does not exist, and -1, changing
+// nothing, if the JSON hashtags of the post are no longer ARGV[4]. See
+// Post.edit.
+var redisEditPost = redis.NewScript(-1, `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+local f = redis.call("HMGET", KEYS[1], "text", "time", "edited", "history",
+	"tags")
+if (f[5] or "") ~= ARGV[4] then
+	return -1
+end
+local old = tonumber(ARGV[6])
+for i = 2, old + 1 do
+	redis.call("ZREM", KEYS[i], ARGV[5])
+end
+for i = old + 2, #KEYS do
+	redis.call("ZADD", KEYS[i], tonumber(f[2]) or 0, ARGV[5])
+end
+local since = tonumber(f[3]) or 0
+if since == 0 then
+	since = tonumber(f[2]) or 0
+end
+local history = {}
+if f[4] and f[4] ~= "" then
+	history = cjson.decode(f[4])
+end
+table.insert(history, 1, {Text = f[1] or "", Time = since})
+while #history > tonumber(ARGV[3]) do
+	table.remove(history)
+end
+redis.call("HMSET", KEYS[1], "text", ARGV[1], "edited", ARGV[2],
+	"history", cjson.encode(history), "tags", ARGV[7])
+return 1
+`)
+
+// EditPost implements Store.
+func (s *redisStore) EditPost(ctx context.Context, p *Post, text string,
+	t int64) error {
+	conn, err := s.conn(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer conn.Close()
 
-	posts := []Post{}
+	// The keys of the hashtag sets are passed to the script, so the old
+	// hashtags are read first. The script changes nothing if they were
+	// edited in the meantime, then they are read again.
+	tags := postTags(text)
+	for {
+		old, err := redis.String(conn.Do("HGET", s.ks.post(p.Name), "tags"))
+		if err != nil && err != redis.ErrNil {
+			return err
+		}
+		oldTags := stringList{}
+		if err = oldTags.RedisScan([]byte(old)); err != nil {
+			return err
+		}
 
-	for _, name := range postNames {
-		val, err := redis.Values(conn.Do("HGETALL", postTag+name))
-		if err != nil {
-			return nil, err
+		args := redis.Args{1 + len(oldTags) + len(tags), s.ks.post(p.Name)}
+		for _, tag := range oldTags {
+			args = args.Add(s.ks.tag(tag))
 		}
+		for _, tag := range tags {
+			args = args.Add(s.ks.tag(tag))
+		}
+		args = args.Add(text, t, postHistoryLen, old, p.Name, len(oldTags),
+			tags)
 
-		p := new(Post)
-		err = redis.ScanStruct(val, p)
+		edited, err := redis.Int(redisEditPost.Do(conn, args...))
+		switch {
+		case err != nil:
+			return err
+		case edited == 0:
+			return ErrNotFound
+		case edited == 1:
+			return nil
+		}
+	}
+}
+
+// DeletePost implements Store.
+func (s *redisStore) DeletePost(ctx context.Context, p *Post) error {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// A like, a mention, a follow or a hashtag added meanwhile is left
+	// in the set of its user or of the hashtag, where it is skipped as a
+	// deleted post.
+	likes, err := redisGetLikes(conn, s.ks, []string{p.Name})
+	if err != nil {
+		return err
+	}
+	mentions, err := redisGetMentions(conn, s.ks, []string{p.Name})
+	if err != nil {
+		return err
+	}
+	job, err := json.Marshal(fanOut{foldName(p.AuthorName), p.Name, p.Time,
+		true})
+	if err != nil {
+		return err
+	}
+	var tags stringList
+	val, err := conn.Do("HGET", s.ks.post(p.Name), "tags")
+	if err != nil {
+		return err
+	}
+	if err = tags.RedisScan(val); err != nil {
+		return err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("DEL", s.ks.post(p.Name), s.ks.comments(p.Name),
+		s.ks.likes(p.Name), s.ks.mentions(p.Name))
+	conn.Send("ZREM", s.ks.timeline(p.AuthorName), p.Name)
+	for _, l := range likes[p.Name] {
+		conn.Send("ZREM", s.ks.liked(l.UserName), p.Name)
+	}
+	for _, m := range mentions[p.Name] {
+		conn.Send("ZREM", s.ks.mentioned(m.UserName), p.Name)
+	}
+	for _, tag := range tags {
+		conn.Send("ZREM", s.ks.tag(tag), p.Name)
+	}
+	conn.Send("LPUSH", s.ks.fanOutQueue(), job)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// A fanOut adds a post to the feeds of the followers of its author, or
+// takes it out of them. AddPost and DeletePost queue them, so requests
+// do not wait for authors with many followers, see runFanOut.
+type fanOut struct {
+	Author string // Folded name
+	Post   string
+	Time   int64
+	Delete bool
+}
+
+// redisFanOut adds the post ARGV[2], scored by ARGV[3], to the feeds at
+// the odd keys after KEYS[2], which keep at most ARGV[4] posts, if the
+// post hash at KEYS[1] exists. A post is only added to the feeds of the
+// users who still follow the user ARGV[1] in the following set at the
+// key before their feed. If ARGV[5] is "1" it takes the post out of the
+// feeds instead.
+var redisFanOut = redis.NewScript(-1, `
+local add = ARGV[5] ~= "1" and redis.call("EXISTS", KEYS[1]) == 1
+for i = 2, #KEYS, 2 do
+	if ARGV[5] == "1" then
+		redis.call("ZREM", KEYS[i + 1], ARGV[2])
+	elseif add and redis.call("ZSCORE", KEYS[i], ARGV[1]) then
+		redis.call("ZADD", KEYS[i + 1], ARGV[3], ARGV[2])
+		redis.call("ZREMRANGEBYRANK", KEYS[i + 1], 0, -tonumber(ARGV[4]) - 1)
+	end
+end
+return 1
+`)
+
+// runFanOut runs the queued fan-outs, forever. The followers of the
+// author are read when the fan-out runs, in batches:
+//
+// A user who starts following the author before gets the post with the
+// latest posts of the author, see Follow, the fan-out adds it again,
+// which changes nothing. A user who stops following the author is
+// skipped by redisFanOut, even in the middle of the fan-out. A post
+// deleted before its fan-out runs is not added to any feed.
+//
+// The fan-outs left running by a stopped server, or by another one
+// sharing the keyspace, are queued again first, so some may run twice,
+// which changes nothing either.
+func (s *redisStore) runFanOut() {
+	for {
+		err := s.requeueFanOuts()
+		if err == nil {
+			break
+		}
+		log.Printf("fan-out: %v", err)
+		time.Sleep(redisFanOutWait)
+	}
+	for {
+		if _, err := s.fanOutNext(redisFanOutWait); err != nil {
+			log.Printf("fan-out: %v", err)
+			time.Sleep(redisFanOutWait)
+		}
+	}
+}
+
+// requeueFanOuts moves the running fan-outs back to the queue.
+func (s *redisStore) requeueFanOuts() error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	for {
+		_, err := redis.Bytes(conn.Do("RPOPLPUSH", s.ks.fanOutRunning(),
+			s.ks.fanOutQueue()))
+		switch {
+		case err == redis.ErrNil:
+			return nil
+		case err != nil:
+			return err
+		}
+	}
+}
+
+// fanOutNext runs the oldest queued fan-out, waiting for one for wait at
+// most, rounded down to seconds, or not at all if wait is 0. It reports
+// whether there was one. The fan-out stays in the running list until it
+// is done.
+func (s *redisStore) fanOutNext(wait time.Duration) (bool, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	var job []byte
+	var err error
+	if wait == 0 {
+		job, err = redis.Bytes(conn.Do("RPOPLPUSH", s.ks.fanOutQueue(),
+			s.ks.fanOutRunning()))
+	} else {
+		job, err = redis.Bytes(redis.DoWithTimeout(conn, wait+time.Second,
+			"BRPOPLPUSH", s.ks.fanOutQueue(), s.ks.fanOutRunning(),
+			int(wait/time.Second)))
+	}
+	switch {
+	case err == redis.ErrNil:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	f := fanOut{}
+	if err = json.Unmarshal(job, &f); err != nil {
+		log.Printf("fan-out: dropping %q: %v", job, err)
+	} else if err = redisRunFanOut(conn, s.ks, f); err != nil {
+		return true, err
+	}
+	_, err = conn.Do("LREM", s.ks.fanOutRunning(), 1, job)
+	return true, err
+}
+
+// redisRunFanOut runs f, scanning the followers of its author in
+// batches of about redisFanOutBatch.
+func redisRunFanOut(conn redis.Conn, ks keyspace, f fanOut) error {
+	cursor := 0
+	for {
+		val, err := redis.Values(conn.Do("ZSCAN", ks.followers(f.Author),
+			cursor, "COUNT", redisFanOutBatch))
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if cursor, err = redis.Int(val[0], nil); err != nil {
+			return err
+		}
+		// Followers and their scores alternate.
+		members, err := redis.Strings(val[1], nil)
+		if err != nil {
+			return err
+		}
+
+		if len(members) > 0 {
+			args := redis.Args{1 + len(members), ks.post(f.Post)}
+			for i := 0; i < len(members); i += 2 {
+				args = args.Add(ks.following(members[i]), ks.feed(members[i]))
+			}
+			args = args.Add(f.Author, f.Post, f.Time, feedLen, f.Delete)
+			if _, err = redisFanOut.Do(conn, args...); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
 		}
-		posts = append(posts, *p)
 	}
+}
 
-	return posts, nil
+// GetComments implements Store. The comments of all the posts are read
+// in a single pipeline.
+func (s *redisStore) GetComments(ctx context.Context,
+	names []string) (map[string][]Comment, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return redisGetComments(conn, s.ks, names)
+}
+
+// redisGetComments returns the comments on the posts with the given
+// names, by post name.
+func redisGetComments(conn redis.Conn, ks keyspace,
+	names []string) (map[string][]Comment, error) {
+	keys := []string{}
+	for _, name := range names {
+		keys = append(keys, ks.comments(name))
+	}
+	vals, err := redisHashValues(conn, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	comments := make(map[string][]Comment)
+	for i, name := range names {
+		cs := []Comment{}
+		for _, v := range vals[i] {
+			c := Comment{}
+			if err := json.Unmarshal([]byte(v), &c); err != nil {
+				return nil, err
+			}
+			cs = append(cs, c)
+		}
+		comments[name] = cs
+	}
+	return comments, nil
+}
+
+// redisHashValues returns the values of the hashes at keys, read in a
+// single pipeline.
+func redisHashValues(conn redis.Conn, keys []string) ([][]string, error) {
+	for _, k := range keys {
+		conn.Send("HVALS", k)
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+
+	// Read all the replies before using them, see redisGetPosts.
+	vals := make([][]string, len(keys))
+	var err error
+	for i := range keys {
+		v, e := redis.Strings(conn.Receive())
+		if e != nil && err == nil {
+			err = e
+		}
+		vals[i] = v
+	}
+	if err != nil {
+		return nil, err
+	}
+	return vals, nil
+}
+
+// redisAddComment sets the field ARGV[1] of the comments hash at KEYS[2]
+// to ARGV[3], if the post hash at KEYS[1] exists and takes comments and
+// the comment ARGV[2], if not empty, exists. It returns 1 if the comment
+// is added, 0 if the post does not exist, -1 if it does not take
+// comments and -2 if the comment replied to does not exist.
+var redisAddComment = redis.NewScript(2, `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+if redis.call("HGET", KEYS[1], "no_comments") == "1" then
+	return -1
+end
+if ARGV[2] ~= "" and redis.call("HEXISTS", KEYS[2], ARGV[2]) == 0 then
+	return -2
+end
+redis.call("HSET", KEYS[2], ARGV[1], ARGV[3])
+return 1
+`)
+
+// AddComment implements Store.
+func (s *redisStore) AddComment(ctx context.Context, p *Post,
+	c *Comment) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	added, err := redis.Int(redisAddComment.Do(conn, s.ks.post(p.Name),
+		s.ks.comments(p.Name), c.ID, c.Parent, data))
+	switch {
+	case err != nil:
+		return err
+	case added == -1:
+		return ErrCommentsOff
+	case added != 1:
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteComments implements Store.
+func (s *redisStore) DeleteComments(ctx context.Context, p *Post,
+	ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	args := redis.Args{}.Add(s.ks.comments(p.Name)).AddFlat(ids)
+	_, err = conn.Do("HDEL", args...)
+	return err
+}
+
+// redisSetIfExists sets the field ARGV[1] of the hash at KEYS[1] to
+// ARGV[2], only if the hash exists. It returns 1 if the field is set,
+// otherwise 0.
+var redisSetIfExists = redis.NewScript(1, `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+// SetCommentsOff implements Store.
+func (s *redisStore) SetCommentsOff(ctx context.Context, p *Post,
+	off bool) error {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	set, err := redis.Int(redisSetIfExists.Do(conn, s.ks.post(p.Name),
+		"no_comments", off))
+	switch {
+	case err != nil:
+		return err
+	case set == 0:
+		return ErrNotFound
+	}
+	return nil
+}
+
+// redisLikePost sets the field ARGV[1] of the likes hash at KEYS[2] to
+// the like ARGV[4] and adds the post ARGV[3] to the liked set at KEYS[3],
+// scored by ARGV[2], if the post hash at KEYS[1] exists. If ARGV[5] is
+// not "1" it removes the like instead. It returns the number of likes of
+// the post, or -1 if the post does not exist.
+var redisLikePost = redis.NewScript(3, `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return -1
+end
+if ARGV[5] == "1" then
+	if redis.call("HSETNX", KEYS[2], ARGV[1], ARGV[4]) == 1 then
+		redis.call("ZADD", KEYS[3], ARGV[2], ARGV[3])
+	end
+elseif redis.call("HDEL", KEYS[2], ARGV[1]) == 1 then
+	redis.call("ZREM", KEYS[3], ARGV[3])
+end
+return redis.call("HLEN", KEYS[2])
+`)
+
+// LikePost implements Store.
+func (s *redisStore) LikePost(ctx context.Context, p *Post,
+	username string, like bool, t int64) (int, error) {
+	data, err := json.Marshal(Like{p.Name, username, t})
+	if err != nil {
+		return 0, err
+	}
+
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	n, err := redis.Int(redisLikePost.Do(conn, s.ks.post(p.Name),
+		s.ks.likes(p.Name), s.ks.liked(username), foldName(username), t,
+		p.Name, data, like))
+	switch {
+	case err != nil:
+		return 0, err
+	case n == -1:
+		return 0, ErrNotFound
+	}
+	return n, nil
+}
+
+// redisGetLikes returns the likes of the posts with the given names, by
+// post name.
+func redisGetLikes(conn redis.Conn, ks keyspace,
+	names []string) (map[string][]Like, error) {
+	keys := []string{}
+	for _, name := range names {
+		keys = append(keys, ks.likes(name))
+	}
+	vals, err := redisHashValues(conn, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	likes := make(map[string][]Like)
+	for i, name := range names {
+		ls := []Like{}
+		for _, v := range vals[i] {
+			l := Like{}
+			if err := json.Unmarshal([]byte(v), &l); err != nil {
+				return nil, err
+			}
+			ls = append(ls, l)
+		}
+		likes[name] = ls
+	}
+	return likes, nil
+}
+
+// GetLikers implements Store.
+func (s *redisStore) GetLikers(ctx context.Context,
+	names []string) (map[string][]string, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	likes, err := redisGetLikes(conn, s.ks, names)
+	if err != nil {
+		return nil, err
+	}
+
+	likers := make(map[string][]string)
+	for name, ls := range likes {
+		users := []string{}
+		for _, l := range ls {
+			users = append(users, l.UserName)
+		}
+		sort.Strings(users)
+		likers[name] = users
+	}
+	return likers, nil
+}
+
+// GetLikedPosts implements Store.
+func (s *redisStore) GetLikedPosts(ctx context.Context, username string,
+	before int64, n int) ([]Post, int64, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	names, next, err := redisRevPage(conn, s.ks.liked(username), before, n)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	posts, err := redisGetPosts(conn, s.ks, names)
+	if err != nil {
+		return nil, 0, err
+	}
+	return existingPosts(posts), next, nil
+}
+
+// redisAddMentions sets the fields of the mentions hash at KEYS[2] to
+// the mentions that follow ARGV[2], as pairs of folded name and JSON
+// mention, and adds the post ARGV[1] to the mentioned sets at KEYS[3]
+// and on, one for each pair, scored by ARGV[2], if the post hash at
+// KEYS[1] exists. Existing mentions are left alone. It returns 0 if the
+// post does not exist.
+var redisAddMentions = redis.NewScript(-1, `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+for i = 1, #KEYS - 2 do
+	if redis.call("HSETNX", KEYS[2], ARGV[1 + 2 * i], ARGV[2 + 2 * i]) == 1 then
+		redis.call("ZADD", KEYS[2 + i], ARGV[2], ARGV[1])
+	end
+end
+return 1
+`)
+
+// AddMentions implements Store.
+func (s *redisStore) AddMentions(ctx context.Context, p *Post,
+	usernames []string, t int64) error {
+	// The script takes a variable number of keys, their count goes
+	// first.
+	args := redis.Args{2 + len(usernames), s.ks.post(p.Name),
+		s.ks.mentions(p.Name)}
+	for _, name := range usernames {
+		args = args.Add(s.ks.mentioned(name))
+	}
+	args = args.Add(p.Name, t)
+	for _, name := range usernames {
+		data, err := json.Marshal(Mention{p.Name, name, t})
+		if err != nil {
+			return err
+		}
+		args = args.Add(foldName(name), data)
+	}
+
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	added, err := redis.Int(redisAddMentions.Do(conn, args...))
+	switch {
+	case err != nil:
+		return err
+	case added == 0:
+		return ErrNotFound
+	}
+	return nil
+}
+
+// redisGetMentions returns the mentions in the posts with the given
+// names, by post name.
+func redisGetMentions(conn redis.Conn, ks keyspace,
+	names []string) (map[string][]Mention, error) {
+	keys := []string{}
+	for _, name := range names {
+		keys = append(keys, ks.mentions(name))
+	}
+	vals, err := redisHashValues(conn, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	mentions := make(map[string][]Mention)
+	for i, name := range names {
+		ms := []Mention{}
+		for _, v := range vals[i] {
+			m := Mention{}
+			if err := json.Unmarshal([]byte(v), &m); err != nil {
+				return nil, err
+			}
+			ms = append(ms, m)
+		}
+		mentions[name] = ms
+	}
+	return mentions, nil
+}
+
+// GetMentioned implements Store.
+func (s *redisStore) GetMentioned(ctx context.Context,
+	names []string) (map[string][]string, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	mentions, err := redisGetMentions(conn, s.ks, names)
+	if err != nil {
+		return nil, err
+	}
+
+	mentioned := make(map[string][]string)
+	for name, ms := range mentions {
+		users := []string{}
+		for _, m := range ms {
+			users = append(users, m.UserName)
+		}
+		sort.Strings(users)
+		mentioned[name] = users
+	}
+	return mentioned, nil
+}
+
+// GetMentionPosts implements Store.
+func (s *redisStore) GetMentionPosts(ctx context.Context, username string,
+	before int64, n int) ([]Post, int64, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	names, next, err := redisRevPage(conn, s.ks.mentioned(username),
+		before, n)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	posts, err := redisGetPosts(conn, s.ks, names)
+	if err != nil {
+		return nil, 0, err
+	}
+	return existingPosts(posts), next, nil
+}
+
+// redisFollow makes the user ARGV[1] follow the user ARGV[2] since the
+// time ARGV[3], if the user hash at KEYS[1] exists, adding them to the
+// following set at KEYS[2] and to the followers set at KEYS[3]. It also
+// adds the latest ARGV[5] posts in the timeline at KEYS[5] to the feed at
+// KEYS[4], which keeps at most ARGV[6] posts. If ARGV[4] is not "1" it
+// undoes the follow and takes the latest ARGV[6] posts in the timeline,
+// the only ones the feed can hold, out of the feed instead. It returns 0 if the user to follow does not exist and -1,
+// without following, if one of the users is in the blocking set of the
+// other, at KEYS[6] and KEYS[7].
+var redisFollow = redis.NewScript(7, `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+if ARGV[4] == "1" and (redis.call("ZSCORE", KEYS[6], ARGV[2]) or
+	redis.call("ZSCORE", KEYS[7], ARGV[1])) then
+	return -1
+end
+if ARGV[4] == "1" then
+	if not redis.call("ZSCORE", KEYS[2], ARGV[2]) then
+		redis.call("ZADD", KEYS[2], ARGV[3], ARGV[2])
+		redis.call("ZADD", KEYS[3], ARGV[3], ARGV[1])
+		local posts = redis.call("ZREVRANGE", KEYS[5], 0,
+			tonumber(ARGV[5]) - 1, "WITHSCORES")
+		for i = 1, #posts, 2 do
+			redis.call("ZADD", KEYS[4], posts[i + 1], posts[i])
+		end
+		redis.call("ZREMRANGEBYRANK", KEYS[4], 0, -tonumber(ARGV[6]) - 1)
+	end
+elseif redis.call("ZREM", KEYS[2], ARGV[2]) == 1 then
+	redis.call("ZREM", KEYS[3], ARGV[1])
+	for _, post in ipairs(redis.call("ZREVRANGE", KEYS[5], 0,
+		tonumber(ARGV[6]) - 1)) do
+		redis.call("ZREM", KEYS[4], post)
+	end
+end
+return 1
+`)
+
+// Follow implements Store.
+func (s *redisStore) Follow(ctx context.Context, username, other string,
+	follow bool, t int64) error {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	found, err := redis.Int(redisFollow.Do(conn, s.ks.user(other),
+		s.ks.following(username), s.ks.followers(other),
+		s.ks.feed(username), s.ks.timeline(other), s.ks.blocking(username),
+		s.ks.blocking(other), foldName(username), foldName(other), t,
+		follow, feedBackfill, feedLen))
+	switch {
+	case err != nil:
+		return err
+	case found == 0:
+		return ErrNotFound
+	case found < 0:
+		return ErrBlocked
+	}
+	return nil
+}
+
+// IsFollowing implements Store.
+func (s *redisStore) IsFollowing(ctx context.Context, username,
+	other string) (bool, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	_, err = redis.Int64(conn.Do("ZSCORE", s.ks.following(username),
+		foldName(other)))
+	switch {
+	case err == redis.ErrNil:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
+
+// GetFollowCounts implements Store.
+func (s *redisStore) GetFollowCounts(ctx context.Context,
+	username string) (int, int, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+
+	conn.Send("ZCARD", s.ks.followers(username))
+	conn.Send("ZCARD", s.ks.following(username))
+	if err = conn.Flush(); err != nil {
+		return 0, 0, err
+	}
+	followers, err := redis.Int(conn.Receive())
+	following, e := redis.Int(conn.Receive())
+	if err == nil {
+		err = e
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return followers, following, nil
+}
+
+// GetFeed implements Store.
+func (s *redisStore) GetFeed(ctx context.Context, username string,
+	before int64, n int) ([]Post, int64, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	names, next, err := redisRevPage(conn, s.ks.feed(username), before, n)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	posts, err := redisGetPosts(conn, s.ks, names)
+	if err != nil {
+		return nil, 0, err
+	}
+	return existingPosts(posts), next, nil
+}
+
+// redisBlock makes the user ARGV[1] block the user ARGV[2] since the
+// time ARGV[3], if the user hash at KEYS[1] exists, adding them to the
+// blocking set at KEYS[2] and to the blockers set at KEYS[3]. It also
+// ends the follows between them both ways: KEYS[4] to KEYS[7] are the
+// following, followers, feed and timeline keys of a follow of ARGV[2] by
+// ARGV[1], see redisFollow, KEYS[8] to KEYS[11] those of the opposite
+// follow, the latest ARGV[5] posts of the timelines are taken out of the
+// feeds. If ARGV[4] is not "1" it only undoes the block. It returns 0 if
+// the user to block does not exist.
+var redisBlock = redis.NewScript(11, `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+if ARGV[4] ~= "1" then
+	redis.call("ZREM", KEYS[2], ARGV[2])
+	redis.call("ZREM", KEYS[3], ARGV[1])
+	return 1
+end
+if not redis.call("ZSCORE", KEYS[2], ARGV[2]) then
+	redis.call("ZADD", KEYS[2], ARGV[3], ARGV[2])
+	redis.call("ZADD", KEYS[3], ARGV[3], ARGV[1])
+end
+if redis.call("ZREM", KEYS[4], ARGV[2]) == 1 then
+	redis.call("ZREM", KEYS[5], ARGV[1])
+	for _, post in ipairs(redis.call("ZREVRANGE", KEYS[7], 0,
+		tonumber(ARGV[5]) - 1)) do
+		redis.call("ZREM", KEYS[6], post)
+	end
+end
+if redis.call("ZREM", KEYS[8], ARGV[1]) == 1 then
+	redis.call("ZREM", KEYS[9], ARGV[2])
+	for _, post in ipairs(redis.call("ZREVRANGE", KEYS[11], 0,
+		tonumber(ARGV[5]) - 1)) do
+		redis.call("ZREM", KEYS[10], post)
+	end
+end
+return 1
+`)
+
+// Block implements Store.
+func (s *redisStore) Block(ctx context.Context, username, other string,
+	block bool, t int64) error {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	found, err := redis.Int(redisBlock.Do(conn, s.ks.user(other),
+		s.ks.blocking(username), s.ks.blockers(other),
+		s.ks.following(username), s.ks.followers(other),
+		s.ks.feed(username), s.ks.timeline(other), s.ks.following(other),
+		s.ks.followers(username), s.ks.feed(other), s.ks.timeline(username),
+		foldName(username), foldName(other), t, block, feedLen))
+	switch {
+	case err != nil:
+		return err
+	case found == 0:
+		return ErrNotFound
+	}
+	return nil
+}
+
+// redisMute makes the user owning the muting set at KEYS[2] mute the
+// user ARGV[1] since the time ARGV[2], if the user hash at KEYS[1]
+// exists. If ARGV[3] is not "1" it undoes the mute instead. It returns 0
+// if the user to mute does not exist.
+var redisMute = redis.NewScript(2, `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+if ARGV[3] ~= "1" then
+	redis.call("ZREM", KEYS[2], ARGV[1])
+elseif not redis.call("ZSCORE", KEYS[2], ARGV[1]) then
+	redis.call("ZADD", KEYS[2], ARGV[2], ARGV[1])
+end
+return 1
+`)
+
+// Mute implements Store.
+func (s *redisStore) Mute(ctx context.Context, username, other string,
+	mute bool, t int64) error {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	found, err := redis.Int(redisMute.Do(conn, s.ks.user(other),
+		s.ks.muting(username), foldName(other), t, mute))
+	switch {
+	case err != nil:
+		return err
+	case found == 0:
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetBlocks implements Store.
+func (s *redisStore) GetBlocks(ctx context.Context,
+	username string) (*Blocks, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	b := newBlocks()
+	sets := []map[string]bool{b.Blocking, b.Blockers, b.Muting}
+	conn.Send("ZRANGE", s.ks.blocking(username), 0, -1)
+	conn.Send("ZRANGE", s.ks.blockers(username), 0, -1)
+	conn.Send("ZRANGE", s.ks.muting(username), 0, -1)
+	if err = conn.Flush(); err != nil {
+		return nil, err
+	}
+	for _, set := range sets {
+		names, e := redis.Strings(conn.Receive())
+		if e != nil && err == nil {
+			err = e
+		}
+		for _, name := range names {
+			set[name] = true
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// GetTagPosts implements Store.
+func (s *redisStore) GetTagPosts(ctx context.Context, tag string,
+	before int64, n int) ([]Post, int64, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	names, next, err := redisRevPage(conn, s.ks.tag(tag), before, n)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	posts, err := redisGetPosts(conn, s.ks, names)
+	if err != nil {
+		return nil, 0, err
+	}
+	return existingPosts(posts), next, nil
+}
+
+// redisFlat flatens a struct for Redis HMSET
+func redisFlat(key string, value interface{}) redis.Args {
+	return redis.Args{}.Add(key).AddFlat(value)
+}
+
+// redisJSON returns v encoded as JSON for a field of a Redis hash, or an
+// empty string if v is empty.
+func redisJSON(v interface{}, empty bool) interface{} {
+	if empty {
+		return ""
+	}
+	data, _ := json.Marshal(v)
+	return data
+}
+
+// redisScanJSON decodes the JSON field of a Redis hash in src into v,
+// leaving v alone if the field is empty.
+func redisScanJSON(src interface{}, v interface{}) error {
+	data, ok := src.([]byte)
+	if !ok || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// redisGetUser search for an user with the given username,
+// it returns the user data if the user is found, otherwise,
+// it returns ErrNotFound.
+func redisGetUser(conn redis.Conn, ks keyspace,
+	username string) (*User, error) {
+	val, err := redis.Values(conn.Do("HGETALL", ks.user(username)))
+	switch {
+	case err != nil:
+		return nil, err
+	case len(val) == 0:
+		return nil, ErrNotFound
+	}
+
+	usr := new(User)
+	err = redis.ScanStruct(val, usr)
+	if err != nil {
+		return nil, err
+	}
+
+	return usr, nil
+}
+
+// redisRevPage returns the names of about n members of the sorted set
+// at key with a score lower than before, starting from the highest
+// score, and the cursor of the next page, see Store.GetTimeline.
+func redisRevPage(conn redis.Conn, key string, before int64,
+	n int) ([]string, int64, error) {
+	max := "+inf"
+	if before > 0 {
+		max = "(" + strconv.FormatInt(before, 10)
+	}
+
+	// Get one more member, to know if there is a next page
+	val, err := redis.Values(conn.Do("ZREVRANGEBYSCORE", key, max, "-inf",
+		"WITHSCORES", "LIMIT", 0, n+1))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var members []struct {
+		Name  string
+		Score int64
+	}
+	if err = redis.ScanSlice(val, &members); err != nil {
+		return nil, 0, err
+	}
+
+	names := []string{}
+	for _, m := range members {
+		names = append(names, m.Name)
+	}
+	if len(members) <= n {
+		return names, 0, nil
+	}
+	last := members[n-1].Score
+	if members[n].Score != last {
+		return names[:n], last, nil
+	}
+
+	// The page would split the members with the last score, so get all
+	// of them, even if they are more than n.
+	i := n - 1
+	for i > 0 && members[i-1].Score == last {
+		i--
+	}
+	ties, err := redis.Strings(conn.Do("ZREVRANGEBYSCORE", key, last, last))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return append(names[:i], ties...), last, nil
+}
+
+// redisGetPosts returns the posts with the given names, in the same
+// order. All the posts are requested in a single pipeline, so loading a
+// page costs one round trip to Redis whatever its length.
+func redisGetPosts(conn redis.Conn, ks keyspace,
+	postNames []string) ([]Post, error) {
+	for _, name := range postNames {
+		conn.Send("HGETALL", ks.post(name))
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+
+	// Read all the replies before scanning them, so an error never
+	// leaves replies pending on the connection.
+	vals := make([][]interface{}, len(postNames))
+	var err error
+	for i := range postNames {
+		v, e := redis.Values(conn.Receive())
+		if e != nil && err == nil {
+			err = e
+		}
+		vals[i] = v
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	posts := []Post{}
+	for _, val := range vals {
+		p := new(Post)
+		if err := redis.ScanStruct(val, p); err != nil {
+			return nil, err
+		}
+		posts = append(posts, *p)
+	}
+
+	return posts, nil
+}
+
+// redisKeys returns all the keys in Redis matching pattern.
+func redisKeys(conn redis.Conn, pattern string) ([]string, error) {
+	keys := []string{}
+	cursor := 0
+	for {
+		val, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern))
+		if err != nil {
+			return nil, err
+		}
+
+		var batch []string
+		if _, err = redis.Scan(val, &cursor, &batch); err != nil {
+			return nil, err
+		}
+		keys = append(keys, batch...)
+
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
+
+// Snapshot implements Store.
+func (s *redisStore) Snapshot(ctx context.Context) (*Snapshot, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	snap := &Snapshot{
+		Users:     []User{},
+		Timelines: make(map[string][]scoredMember),
+	}
+
+	snap.Version, err = redisSchemaVersion(conn, s.ks)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := s.ks.scan(conn, userTag)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		usr, err := redisGetUser(conn, s.ks, name)
+		if err != nil {
+			return nil, err
+		}
+		snap.Users = append(snap.Users, *usr)
+	}
+
+	names, err = s.ks.scan(conn, postTag)
+	if err != nil {
+		return nil, err
+	}
+	if snap.Posts, err = redisGetPosts(conn, s.ks, names); err != nil {
+		return nil, err
+	}
+
+	names, err = s.ks.scan(conn, commentsTag)
+	if err != nil {
+		return nil, err
+	}
+	comments, err := redisGetComments(conn, s.ks, names)
+	if err != nil {
+		return nil, err
+	}
+	snap.Comments = []Comment{}
+	for _, cs := range comments {
+		snap.Comments = append(snap.Comments, cs...)
+	}
+
+	names, err = s.ks.scan(conn, likesTag)
+	if err != nil {
+		return nil, err
+	}
+	likes, err := redisGetLikes(conn, s.ks, names)
+	if err != nil {
+		return nil, err
+	}
+	snap.Likes = []Like{}
+	for _, ls := range likes {
+		snap.Likes = append(snap.Likes, ls...)
+	}
+
+	names, err = s.ks.scan(conn, mentionsTag)
+	if err != nil {
+		return nil, err
+	}
+	mentions, err := redisGetMentions(conn, s.ks, names)
+	if err != nil {
+		return nil, err
+	}
+	snap.Mentions = []Mention{}
+	for _, ms := range mentions {
+		snap.Mentions = append(snap.Mentions, ms...)
+	}
+
+	names, err = s.ks.scan(conn, followingTag)
+	if err != nil {
+		return nil, err
+	}
+	snap.Follows = []Follow{}
+	for _, name := range names {
+		members, err := redisSortedSet(conn, s.ks.following(name))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range members {
+			snap.Follows = append(snap.Follows,
+				Follow{name, m.Member, m.Score})
+		}
+	}
+
+	snap.Blocks, err = redisRelations(conn, s.ks, blockingTag)
+	if err != nil {
+		return nil, err
+	}
+	snap.Mutes, err = redisRelations(conn, s.ks, mutingTag)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err = s.ks.scan(conn, userTimeline)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		snap.Timelines[name], err = redisSortedSet(conn, s.ks.timeline(name))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	names, err = s.ks.scan(conn, feedTag)
+	if err != nil {
+		return nil, err
+	}
+	snap.Feeds = make(map[string][]scoredMember)
+	for _, name := range names {
+		snap.Feeds[name], err = redisSortedSet(conn, s.ks.feed(name))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return snap, nil
+}
+
+// redisRelations returns the relations held in all the sorted sets with
+// the given tag, like blockingTag, by the folded name of their owner.
+func redisRelations(conn redis.Conn, ks keyspace,
+	tag string) ([]Relation, error) {
+	names, err := ks.scan(conn, tag)
+	if err != nil {
+		return nil, err
+	}
+	relations := []Relation{}
+	for _, name := range names {
+		members, err := redisSortedSet(conn, ks.key(tag, name))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range members {
+			relations = append(relations, Relation{name, m.Member, m.Score})
+		}
+	}
+	return relations, nil
+}
+
+// redisSortedSet returns all the members of the sorted set at key.
+func redisSortedSet(conn redis.Conn, key string) ([]scoredMember, error) {
+	val, err := redis.Values(conn.Do("ZRANGE", key, 0, -1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []struct {
+		Member string
+		Score  int64
+	}
+	if err = redis.ScanSlice(val, &entries); err != nil {
+		return nil, err
+	}
+
+	members := []scoredMember{}
+	for _, e := range entries {
+		members = append(members, scoredMember{e.Score, e.Member})
+	}
+	return members, nil
+}
+
+// Restore implements Store. Records are written in a single pipeline.
+func (s *redisStore) Restore(ctx context.Context, snap *Snapshot) error {
+	comments := [][]byte{}
+	for _, c := range snap.Comments {
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		comments = append(comments, data)
+	}
+	likes := [][]byte{}
+	for _, l := range snap.Likes {
+		data, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		likes = append(likes, data)
+	}
+	mentions := [][]byte{}
+	for _, m := range snap.Mentions {
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		mentions = append(mentions, data)
+	}
+
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	n := 0
+	for _, usr := range snap.Users {
+		conn.Send("HMSET", redisFlat(s.ks.user(usr.Name), usr)...)
+		conn.Send("SET", s.ks.email(usr.Email), foldName(usr.Name))
+		n += 2
+	}
+	for _, p := range snap.Posts {
+		conn.Send("HMSET", redisFlat(s.ks.post(p.Name), p)...)
+		n++
+		for _, tag := range p.Tags {
+			conn.Send("ZADD", s.ks.tag(tag), p.Time, p.Name)
+			n++
+		}
+	}
+	for i, c := range snap.Comments {
+		conn.Send("HSET", s.ks.comments(c.PostName), c.ID, comments[i])
+		n++
+	}
+	for i, l := range snap.Likes {
+		conn.Send("HSET", s.ks.likes(l.PostName), foldName(l.UserName),
+			likes[i])
+		conn.Send("ZADD", s.ks.liked(l.UserName), l.Time, l.PostName)
+		n += 2
+	}
+	for i, m := range snap.Mentions {
+		conn.Send("HSET", s.ks.mentions(m.PostName), foldName(m.UserName),
+			mentions[i])
+		conn.Send("ZADD", s.ks.mentioned(m.UserName), m.Time, m.PostName)
+		n += 2
+	}
+	for _, f := range snap.Follows {
+		conn.Send("ZADD", s.ks.following(f.Follower), f.Time, f.Followed)
+		conn.Send("ZADD", s.ks.followers(f.Followed), f.Time, f.Follower)
+		n += 2
+	}
+	for _, r := range snap.Blocks {
+		conn.Send("ZADD", s.ks.blocking(r.From), r.Time, r.To)
+		conn.Send("ZADD", s.ks.blockers(r.To), r.Time, r.From)
+		n += 2
+	}
+	for _, r := range snap.Mutes {
+		conn.Send("ZADD", s.ks.muting(r.From), r.Time, r.To)
+		n++
+	}
+	for name, members := range snap.Timelines {
+		for _, m := range members {
+			conn.Send("ZADD", s.ks.timeline(name), m.Score, m.Member)
+			n++
+		}
+	}
+	for name, members := range snap.Feeds {
+		for _, m := range members {
+			conn.Send("ZADD", s.ks.feed(name), m.Score, m.Member)
+			n++
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		return err
+	}
+
+	for i := 0; i < n; i++ {
+		if _, e := conn.Receive(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
 }
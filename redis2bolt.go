@@ -0,0 +1,52 @@
+/*
+Migration of a Redis keyspace to a bolt database.
+
+Copyright (c) 2015, Luca Chiricozzi. All rights reserved.
+Released under the MIT License.
+http://opensource.org/licenses/MIT
+*/
+package main
+
+import (
+	"context"
+	"log"
+)
+
+// cmdRedisToBolt copies the users, the posts and the timelines stored in
+// the Redis server at -redisServer to the bolt database at -boltPath.
+// Existing records in the bolt database are overwritten, so the command
+// can be run again safely.
+func cmdRedisToBolt(args []string) error {
+	src := newRedisStore(newPool(redisFlagsConfig()),
+		keyspace(*redisNamespace))
+	defer src.pool.Close()
+
+	dst, err := newBoltStore(*boltPath)
+	if err != nil {
+		return err
+	}
+	defer dst.db.Close()
+
+	// Both databases must use the current schema.
+	if err = initSchema(dst); err != nil {
+		return err
+	}
+	for _, s := range []Store{src, dst} {
+		if err = checkSchema(s); err != nil {
+			return err
+		}
+	}
+
+	ctx := context.Background()
+	snap, err := src.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	if err = dst.Restore(ctx, snap); err != nil {
+		return err
+	}
+
+	log.Printf("redis2bolt: %d users, %d posts and %d timelines copied",
+		len(snap.Users), len(snap.Posts), len(snap.Timelines))
+	return nil
+}
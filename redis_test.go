@@ -0,0 +1,605 @@
+/*
+Tests of the Redis Store of GoPics.
+
+Copyright (c) 2015, Luca Chiricozzi. All rights reserved.
+Released under the MIT License.
+http://opensource.org/licenses/MIT
+*/
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/lucachr/gopics/auth"
+)
+
+// testRedisAddr returns the redisConfig of the redis-server used by the
+// tests, at $GOPICS_TEST_REDIS or at the default address, with the
+// password in $GOPICS_TEST_REDIS_PASSWORD, and an error if the server
+// cannot be reached.
+func testRedisAddr() (redisConfig, error) {
+	cfg := redisConfig{
+		Addr:     os.Getenv("GOPICS_TEST_REDIS"),
+		Password: os.Getenv("GOPICS_TEST_REDIS_PASSWORD"),
+	}
+	if cfg.Addr == "" {
+		cfg.Addr = redisDefaultAddr
+	}
+	pool := newPool(cfg)
+	defer pool.Close()
+	conn := pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	return cfg, err
+}
+
+// testRedisConfig is like testRedisAddr, but it skips the test if the
+// server cannot be reached.
+func testRedisConfig(tb testing.TB) redisConfig {
+	cfg, err := testRedisAddr()
+	if err != nil {
+		tb.Skipf("no redis-server at %s: %v", cfg.Addr, err)
+	}
+	return cfg
+}
+
+// testRedisStore returns a redisStore on the test server, under a
+// keyspace of its own that is emptied at the end of the test.
+func testRedisStore(tb testing.TB, cfg redisConfig) *redisStore {
+	return testRedisStoreIn(tb, cfg, keyspace("gopicstest:"+tb.Name()+":"))
+}
+
+// testRedisStoreIn returns a redisStore on the test server under the
+// keyspace ks, which is emptied at the end of the test.
+func testRedisStoreIn(tb testing.TB, cfg redisConfig,
+	ks keyspace) *redisStore {
+	pool := newPool(cfg)
+	s := newRedisStore(pool, ks)
+	clear := func() {
+		conn := pool.Get()
+		defer conn.Close()
+		keys, err := redisKeys(conn, string(s.ks)+"*")
+		if err != nil {
+			tb.Fatal(err)
+		}
+		for _, k := range keys {
+			if _, err = conn.Do("DEL", k); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+	clear()
+	tb.Cleanup(func() {
+		clear()
+		pool.Close()
+	})
+	return s
+}
+
+// TestRedisAuthDB checks that the Store is refused with a wrong
+// password and works in the database given in its configuration.
+func TestRedisAuthDB(t *testing.T) {
+	cfg := testRedisConfig(t)
+	ctx := context.Background()
+	usr := &User{Name: "Alice", Email: "alice@x"}
+	ks := keyspace("gopicstest:" + t.Name() + ":")
+
+	wrong := cfg
+	wrong.Password = cfg.Password + "wrong"
+	bad := newRedisStore(newPool(wrong), ks)
+	defer bad.pool.Close()
+	if err := bad.CreateUser(ctx, usr); err == nil {
+		t.Fatal("CreateUser with a wrong password: got no error")
+	}
+
+	db := cfg
+	db.DB = 3
+	s := testRedisStoreIn(t, db, ks)
+	if err := s.CreateUser(ctx, usr); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		db   int
+		want bool
+	}{{3, true}, {0, false}} {
+		cfg.DB = tc.db
+		got := testRedisExists(t, cfg, s.ks.user("alice"))
+		if got != tc.want {
+			t.Errorf("user key in database %d: got %v, want %v", tc.db,
+				got, tc.want)
+		}
+	}
+}
+
+// testRedisExists reports whether the key k exists on the server of cfg.
+func testRedisExists(t *testing.T, cfg redisConfig, k string) bool {
+	pool := newPool(cfg)
+	defer pool.Close()
+	conn := pool.Get()
+	defer conn.Close()
+	ok, err := redis.Bool(conn.Do("EXISTS", k))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+// testRedisKeys returns all the keys on the server of cfg.
+func testRedisKeys(t *testing.T, cfg redisConfig) map[string]bool {
+	pool := newPool(cfg)
+	defer pool.Close()
+	conn := pool.Get()
+	defer conn.Close()
+	keys, err := redisKeys(conn, "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := map[string]bool{}
+	for _, k := range keys {
+		m[k] = true
+	}
+	return m
+}
+
+// fillRedisStore adds to s a user Alice, with a tagged, edited,
+// commented, liked and mentioning post named shared, followed by Bob,
+// who blocks and mutes Carol.
+func fillRedisStore(t *testing.T, s *redisStore, text string) {
+	ctx := context.Background()
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(s.InitSchema())
+	for _, name := range []string{"Alice", "Bob", "Carol"} {
+		check(s.CreateUser(ctx, &User{Name: name, Email: name + "@x"}))
+	}
+	check(s.Follow(ctx, "bob", "alice", true, 1))
+	check(s.Block(ctx, "bob", "carol", true, 1))
+	check(s.Mute(ctx, "bob", "carol", true, 1))
+
+	p := &Post{
+		Name:       "shared.jpeg",
+		AuthorName: "Alice",
+		Text:       "#sun",
+		Tags:       postTags("#sun"),
+		Time:       2,
+		Images:     stringList{"shared.jpeg"},
+	}
+	check(s.AddPost(ctx, p))
+	check(s.EditPost(ctx, p, text+" #moon", 3))
+	check(s.AddComment(ctx, p, &Comment{ID: "c1", PostName: p.Name,
+		AuthorName: "Bob", Text: "hi", Time: 4}))
+	_, err := s.LikePost(ctx, p, "bob", true, 5)
+	check(err)
+	check(s.AddMentions(ctx, p, []string{"bob"}, 6))
+	runFanOuts(t, s)
+}
+
+// runFanOuts runs the fan-outs queued in s.
+func runFanOuts(tb testing.TB, s *redisStore) {
+	for {
+		ok, err := s.fanOutNext(0)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// TestRedisFanOut checks that the queued fan-outs fill and clean the
+// feeds of the followers the author has when they run.
+func TestRedisFanOut(t *testing.T) {
+	s := testRedisStore(t, testRedisConfig(t))
+	ctx := context.Background()
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	feed := func(name string) int {
+		t.Helper()
+		n, err := redis.Int(conn.Do("ZCARD", s.ks.feed(name)))
+		check(err)
+		return n
+	}
+
+	const n = 2*redisFanOutBatch + 1
+	check(s.CreateUser(ctx, &User{Name: "Alice", Email: "alice@x"}))
+	for i := 0; i < n; i++ {
+		name := "f" + strconv.Itoa(i)
+		check(s.CreateUser(ctx, &User{Name: name, Email: name + "@x"}))
+		check(s.Follow(ctx, name, "alice", true, 1))
+	}
+
+	p := &Post{Name: "p.jpeg", AuthorName: "Alice", Time: 2}
+	check(s.AddPost(ctx, p))
+	if got := feed("f0"); got != 0 {
+		t.Errorf("got %d posts in a feed before the fan-out, want 0", got)
+	}
+
+	// f0 stops following before the fan-out runs, f1 stops and starts
+	// again, it gets the post from the timeline.
+	check(s.Follow(ctx, "f0", "alice", false, 3))
+	check(s.Follow(ctx, "f1", "alice", false, 3))
+	check(s.Follow(ctx, "f1", "alice", true, 3))
+	runFanOuts(t, s)
+	for i := 0; i < n; i++ {
+		want := 1
+		if i == 0 {
+			want = 0
+		}
+		if got := feed("f" + strconv.Itoa(i)); got != want {
+			t.Fatalf("got %d posts in the feed of f%d, want %d", got, i,
+				want)
+		}
+	}
+
+	// A fan-out left running is queued again, and runs twice.
+	check(s.DeletePost(ctx, p))
+	_, err := conn.Do("RPOPLPUSH", s.ks.fanOutQueue(), s.ks.fanOutRunning())
+	check(err)
+	check(s.requeueFanOuts())
+	runFanOuts(t, s)
+	if got := feed("f2"); got != 0 {
+		t.Errorf("got %d posts in a feed after the delete, want 0", got)
+	}
+
+	// A post deleted before its fan-out runs is not added.
+	check(s.AddPost(ctx, p))
+	check(s.DeletePost(ctx, p))
+	runFanOuts(t, s)
+	if got := feed("f2"); got != 0 {
+		t.Errorf("got %d posts in a feed, want 0", got)
+	}
+	got, err := redis.Int(conn.Do("LLEN", s.ks.fanOutRunning()))
+	if err != nil || got != 0 {
+		t.Errorf("got %d fan-outs left running, %v", got, err)
+	}
+}
+
+// TestRedisUnfollow checks that unfollows and blocks take the posts of
+// the other user out of the feed.
+func TestRedisUnfollow(t *testing.T) {
+	s := testRedisStore(t, testRedisConfig(t))
+	ctx := context.Background()
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	feed := func() int {
+		t.Helper()
+		posts, _, err := s.GetFeed(ctx, "Bob", 0, feedLen)
+		check(err)
+		return len(posts)
+	}
+
+	for _, name := range []string{"Alice", "Bob"} {
+		check(s.CreateUser(ctx, &User{Name: name, Email: name + "@x"}))
+	}
+	for i := 0; i < 3; i++ {
+		check(s.AddPost(ctx, &Post{Name: "p" + strconv.Itoa(i),
+			AuthorName: "Alice", Time: int64(i + 1)}))
+	}
+	for _, tc := range []struct {
+		name string
+		undo func() error
+	}{
+		{"unfollow", func() error {
+			return s.Follow(ctx, "Bob", "Alice", false, 5)
+		}},
+		{"block", func() error {
+			return s.Block(ctx, "Bob", "Alice", true, 5)
+		}},
+	} {
+		check(s.Follow(ctx, "Bob", "Alice", true, 4))
+		if got := feed(); got != 3 {
+			t.Fatalf("%s: got %d posts in the feed, want 3", tc.name, got)
+		}
+		check(tc.undo())
+		if got := feed(); got != 0 {
+			t.Errorf("%s: got %d posts in the feed, want 0", tc.name, got)
+		}
+	}
+}
+
+// TestRedisKeyspace checks that two Stores under different keyspaces
+// of the same server do not see each other's data, and that every key
+// they write starts with their keyspace.
+func TestRedisKeyspace(t *testing.T) {
+	cfg := testRedisConfig(t)
+	prefix := "gopicstest:" + t.Name() + ":"
+	a := testRedisStoreIn(t, cfg, keyspace(prefix+"a:"))
+	b := testRedisStoreIn(t, cfg, keyspace(prefix+"b:"))
+	before := testRedisKeys(t, cfg)
+	fillRedisStore(t, a, "from a")
+	fillRedisStore(t, b, "from b")
+	ctx := context.Background()
+
+	for _, s := range []*redisStore{a, b} {
+		for _, k := range []string{s.ks.tag("moon"), s.ks.user("alice"),
+			s.ks.schema()} {
+			if !testRedisExists(t, cfg, k) {
+				t.Errorf("missing key %s", k)
+			}
+		}
+	}
+	for k := range testRedisKeys(t, cfg) {
+		if !before[k] && !strings.HasPrefix(k, string(a.ks)) &&
+			!strings.HasPrefix(k, string(b.ks)) {
+			t.Errorf("key %s is outside the keyspaces", k)
+		}
+	}
+
+	// Deleting in b leaves a alone.
+	if err := b.DeletePost(ctx, &Post{Name: "shared.jpeg",
+		AuthorName: "Alice", Time: 2}); err != nil {
+		t.Fatal(err)
+	}
+	runFanOuts(t, b)
+	if err := b.CreateUser(ctx, &User{Name: "Dave",
+		Email: "dave@x"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.GetUser(ctx, "dave"); err != ErrNotFound {
+		t.Errorf("GetUser of a user of b: got %v, want ErrNotFound", err)
+	}
+	for _, tc := range []struct {
+		s    *redisStore
+		want int
+	}{{a, 1}, {b, 0}} {
+		posts, _, err := tc.s.GetTagPosts(ctx, "moon", 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(posts) != tc.want {
+			t.Fatalf("%s: got %d posts tagged moon, want %d", tc.s.ks,
+				len(posts), tc.want)
+		}
+		if len(posts) > 0 && posts[0].Text != "from a #moon" {
+			t.Errorf("%s: got the post %q", tc.s.ks, posts[0].Text)
+		}
+		if posts, _, err = tc.s.GetTagPosts(ctx, "sun", 0,
+			10); err != nil || len(posts) > 0 {
+			t.Errorf("%s: got %d posts tagged sun, %v", tc.s.ks,
+				len(posts), err)
+		}
+		posts, _, err = tc.s.GetFeed(ctx, "bob", 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(posts) != tc.want {
+			t.Errorf("%s: got %d posts in the feed of bob, want %d",
+				tc.s.ks, len(posts), tc.want)
+		}
+	}
+}
+
+// TestRedisEditTags checks that concurrent edits of a post leave it only
+// in the sets of the hashtags of its last caption.
+func TestRedisEditTags(t *testing.T) {
+	s := testRedisStore(t, testRedisConfig(t))
+	ctx := context.Background()
+	p := &Post{Name: "p.jpeg", AuthorName: "Alice", Text: "#t0",
+		Tags: postTags("#t0"), Time: 1}
+	if err := s.AddPost(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 16
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			errs <- s.EditPost(ctx, p, "#t"+strconv.Itoa(i+1), int64(i+2))
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := s.GetPost(ctx, p.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= n; i++ {
+		tag := "t" + strconv.Itoa(i)
+		posts, _, err := s.GetTagPosts(ctx, tag, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 0
+		if "#"+tag == got.Text {
+			want = 1
+		}
+		if len(posts) != want {
+			t.Errorf("got %d posts tagged %s, want %d", len(posts), tag,
+				want)
+		}
+	}
+}
+
+// TestRedisCtxClose checks that closing a connection whose context is
+// done does not wait for a server that never replies, and that the
+// connection is not put back in the pool.
+func TestRedisCtxClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			go io.Copy(ioutil.Discard, c)
+		}
+	}()
+
+	s := newRedisStore(newPool(redisConfig{Addr: ln.Addr().String()}), "")
+	defer s.pool.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := s.conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Send("GET", "x")
+	conn.Flush()
+	cancel()
+	if _, err = conn.Receive(); err != context.Canceled {
+		t.Fatalf("Receive: got %v, want context.Canceled", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		conn.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * redisDrainTimeout):
+		t.Fatal("Close is waiting for the reply")
+	}
+	if n := s.pool.IdleCount(); n != 0 {
+		t.Errorf("got %d idle connections, want 0", n)
+	}
+}
+
+// serialTimelineStore is a redisStore that loads the posts of timelines
+// with one HGETALL round trip per post, as GoPics did before
+// redisGetPosts pipelined them.
+type serialTimelineStore struct {
+	*redisStore
+}
+
+// GetTimeline implements Store.
+func (s serialTimelineStore) GetTimeline(ctx context.Context,
+	username string, before int64, n int) ([]Post, int64, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	names, next, err := redisRevPage(conn, s.ks.timeline(username),
+		before, n)
+	if err != nil {
+		return nil, 0, err
+	}
+	posts := []Post{}
+	for _, name := range names {
+		val, err := redis.Values(conn.Do("HGETALL", s.ks.post(name)))
+		if err != nil {
+			return nil, 0, err
+		}
+		p := Post{}
+		if err = redis.ScanStruct(val, &p); err != nil {
+			return nil, 0, err
+		}
+		posts = append(posts, p)
+	}
+	return posts, next, nil
+}
+
+// benchTimeline fills the timeline of the user Author with 50 posts.
+func benchTimeline(b *testing.B, s Store) {
+	ctx := context.Background()
+	err := s.CreateUser(ctx, &User{Name: "Author", Email: "author@x"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		p := &Post{
+			Name:       "post" + strconv.Itoa(i),
+			AuthorName: "Author",
+			Text:       "Post #" + strconv.Itoa(i),
+		}
+		if err = s.AddPost(ctx, p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkGetTimeline measures loading the 50 posts of a timeline from
+// Redis one by one and in a single pipeline.
+func BenchmarkGetTimeline(b *testing.B) {
+	s := testRedisStore(b, testRedisConfig(b))
+	benchTimeline(b, s)
+
+	for _, bc := range []struct {
+		name string
+		s    Store
+	}{
+		{"serial", serialTimelineStore{s}},
+		{"pipelined", s},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, _, err := bc.s.GetTimeline(context.Background(),
+					"Author", 0, 50)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkHandleTimeline measures the first page of a 50 posts
+// timeline, seen by a logged user so it is never cached, with the posts
+// loaded one by one and in a single pipeline.
+func BenchmarkHandleTimeline(b *testing.B) {
+	s := testRedisStore(b, testRedisConfig(b))
+	benchTimeline(b, s)
+
+	w := httptest.NewRecorder()
+	auth.SetCookie(w, keyring, "Viewer")
+	cookie := w.Header().Get("Set-Cookie")
+
+	saved := store
+	defer func() { store = saved }()
+	for _, bc := range []struct {
+		name string
+		s    Store
+	}{
+		{"serial", serialTimelineStore{s}},
+		{"pipelined", s},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			store = bc.s
+			for i := 0; i < b.N; i++ {
+				r := httptest.NewRequest("GET", "/Author", nil)
+				r.Header.Set("Cookie", cookie)
+				w := httptest.NewRecorder()
+				appHandler(handleRoot).ServeHTTP(w, r)
+				if w.Code != http.StatusOK {
+					b.Fatalf("got status %d", w.Code)
+				}
+			}
+		})
+	}
+}
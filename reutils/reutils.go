@@ -9,14 +9,52 @@ package reutils
 
 import "regexp"
 
+// Patterns are compiled once, they run on every caption and comment
+// shown.
+var (
+	nameExp     = regexp.MustCompile("^[\\pL\\pN-]+$")
+	emailExp    = regexp.MustCompile("^[a-zA-Z0-9+&*-]+(?:\\.[a-zA-Z0-9_+&*-]+)*@(?:[a-zA-Z0-9-]+\\.)+[a-zA-Z]{2,7}$")
+	tagsExp     = regexp.MustCompile("(?:^|[^\\pL\\pN])(#[\\pL\\pN]+)")
+	mentionsExp = regexp.MustCompile("(?:^|[^\\pL\\pN-])(@[\\pL\\pN-]+)")
+	tagExp      = regexp.MustCompile("^[\\pL\\pN]+$")
+)
+
 // MatchName checks whether a string is a valid name.
 func MatchName(s string) bool {
-	exp := regexp.MustCompile("^[\\pL\\pN-]+$")
-	return exp.MatchString(s)
+	return nameExp.MatchString(s)
 }
 
 // MatchEmail checks whether a string is a valid email.
 func MatchEmail(s string) bool {
-	exp := regexp.MustCompile("^[a-zA-Z0-9+&*-]+(?:\\.[a-zA-Z0-9_+&*-]+)*@(?:[a-zA-Z0-9-]+\\.)+[a-zA-Z]{2,7}$")
-	return exp.MatchString(s)
+	return emailExp.MatchString(s)
+}
+
+// FindTagsIndex returns the start and end of every hashtag in a string:
+// a # followed by letters and digits, not preceded by a letter or a
+// digit. The # is part of the hashtag.
+func FindTagsIndex(s string) [][]int {
+	return findIndex(tagsExp, s)
+}
+
+// FindMentionsIndex returns the start and end of every mention in a
+// string: a @ followed by a valid name, see MatchName, not preceded by a
+// character of a name. The @ is part of the mention.
+func FindMentionsIndex(s string) [][]int {
+	return findIndex(mentionsExp, s)
+}
+
+// findIndex returns the start and end of the first subexpression of
+// every match of exp in s.
+func findIndex(exp *regexp.Regexp, s string) [][]int {
+	locs := [][]int{}
+	for _, m := range exp.FindAllStringSubmatchIndex(s, -1) {
+		locs = append(locs, m[2:4])
+	}
+	return locs
+}
+
+// MatchTag checks whether a string is a valid hashtag name, without the
+// #.
+func MatchTag(s string) bool {
+	return tagExp.MatchString(s)
 }
@@ -10,8 +10,8 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
-	"github.com/garyburd/redigo/redis"
 	"github.com/lucachr/gopics/auth"
 )
 
@@ -20,10 +20,39 @@ const (
 
 	timeLayout = "Mon 2 Jan 2006 15:04"
 
+	// Number of posts in a page of a timeline.
+	timelinePageLen = 20
+
+	// Number of posts kept in a feed, and number of posts of a user added
+	// to the feed of a new follower.
+	feedLen      = 1000
+	feedBackfill = timelinePageLen
+
 	// Redis "tags" for users and posts data.
 	userTag      = "user:"
 	userTimeline = "timeline:"
 	postTag      = "post:"
+	emailTag     = "email:"
+	commentsTag  = "comments:"
+	likesTag     = "likes:"
+	likedTag     = "liked:"
+	tagTag       = "tag:"
+	mentionsTag  = "mentions:"
+	mentionedTag = "mentioned:"
+	followingTag = "following:"
+	followersTag = "followers:"
+	feedTag      = "feed:"
+	blockingTag  = "blocking:"
+	blockersTag  = "blockers:"
+	mutingTag    = "muting:"
+
+	// Redis key of the schema version.
+	schemaKey = "schema:version"
+
+	// Redis keys of the queue of the fan-outs of posts to the feeds and
+	// of the fan-outs running, see runFanOut.
+	fanOutQueueKey   = "fanout:queue"
+	fanOutRunningKey = "fanout:running"
 )
 
 var (
@@ -33,7 +62,7 @@ var (
 		[]byte("e12b872e-a34f-11e4-9c70-902b34a8"),
 	)
 
-	// Invalid usernames.
+	// Invalid usernames, and words usernames cannot contain.
 	invalidUser = []string{
 		"index",
 		"register",
@@ -45,8 +74,53 @@ var (
 		"static",
 	}
 
-	pool        *redis.Pool
+	// Usernames taken by the paths of GoPics, names that only contain
+	// them are fine.
+	reservedNames = []string{
+		"delete",
+		"edit",
+		"comment",
+		"like",
+		"tag",
+		"p",
+		"follow",
+		"feed",
+		"block",
+		"mute",
+	}
+
+	store        Store
+	timelines    = newPageCache()
+	storeBreaker = newBreaker(breakerThreshold, breakerCooldown)
+	storeBackend = flag.String("store", "redis",
+		"storage backend, \"redis\", \"memory\" or \"bolt\"")
 	redisServer = flag.String("redisServer", redisDefaultAddr, "")
+	boltPath    = flag.String("boltPath", boltDefaultPath,
+		"path of the bolt database file")
+	requestTimeout = flag.Duration("requestTimeout", 10*time.Second,
+		"max time spent on the data of a request, 0 for no limit")
+
+	// Options of the connections to Redis
+	redisPassword = flag.String("redisPassword", "",
+		"password of the Redis server")
+	redisDB = flag.Int("redisDB", 0,
+		"index of the Redis database")
+	redisTLS = flag.Bool("redisTLS", false,
+		"connect to Redis over TLS")
+	redisTLSSkipVerify = flag.Bool("redisTLSSkipVerify", false,
+		"do not verify the certificate of the Redis server")
+	redisDialTimeout = flag.Duration("redisDialTimeout", 5*time.Second,
+		"timeout for connecting to Redis, 0 for none")
+	redisReadTimeout = flag.Duration("redisReadTimeout", 0,
+		"timeout for reading a reply from Redis, 0 for none")
+	redisWriteTimeout = flag.Duration("redisWriteTimeout", 0,
+		"timeout for writing a command to Redis, 0 for none")
+	redisMaxActive = flag.Int("redisMaxActive", 0,
+		"max open connections to Redis, 0 for no limit")
+	redisWait = flag.Bool("redisWait", false,
+		"wait for a free connection when -redisMaxActive are open")
+	redisNamespace = flag.String("redisNamespace", "",
+		"prefix of all the Redis keys, like \"gopics:\"")
 
 	// A slice with the path of your media directory
 	basePath = []string{os.Getenv("GOPATH"), "src", "github.com",
@@ -60,6 +134,12 @@ var (
 		"index.html",
 		"register.html",
 		"timeline.html",
+		"posts.html",
+		"tag.html",
+		"post.html",
+		"feed.html",
+		"unavailable.html",
+		"readonly.html",
 		"footer.html",
 	)
 )
@@ -0,0 +1,35 @@
+/**
+ * Copyright (c) 2015, Luca Chiricozzi. All rights reserved.
+ * Released under the MIT License.
+ * http://opensource.org/licenses/MIT
+ */
+$(function() {
+    // Load the next page of a timeline in place, the link still works
+    // as a plain "next page" link without JavaScript.
+    $(document).on('click', '#load-more a', function(e) {
+        e.preventDefault();
+        var more = $('#load-more');
+        $.get(this.href, function(html) {
+            var page = $('<div>').html(html);
+            var posts = page.find('#posts').children();
+            $('#posts').append(posts);
+            more.replaceWith(page.find('#load-more'));
+
+            // Start the carousels of the new posts.
+            posts.find('[data-uk-slideshow]').each(function() {
+                UIkit.slideshow($(this));
+            });
+        });
+    });
+
+    // Like a post, or take the like back, without reloading the page.
+    $(document).on('submit', '.like-form', function(e) {
+        e.preventDefault();
+        var form = $(this);
+        $.post(this.action, form.serialize(), function(res) {
+            form.find('.like-count').text(res.likes);
+            form.find('[name=like]').val(res.liked ? '0' : '1');
+            form.find('button').toggleClass('uk-button-primary', res.liked);
+        }, 'json');
+    });
+});
@@ -0,0 +1,240 @@
+/*
+Storage for GoPics' users, posts and timelines.
+
+Copyright (c) 2015, Luca Chiricozzi. All rights reserved.
+Released under the MIT License.
+http://opensource.org/licenses/MIT
+*/
+package main
+
+import "context"
+
+// A Store keeps the users, the posts and the timelines of GoPics.
+// Handlers only talk to a Store, so the backend can be swapped without
+// touching them. Stores look users up by their folded name and email,
+// see foldName and foldEmail.
+//
+// Every method takes the context of the request it serves. Once the
+// context is done, methods stop waiting for the backend and return the
+// error of the context, or a timeout error of the backend.
+type Store interface {
+	// GetUser returns the user with the given username, if the user
+	// does not exist it returns ErrNotFound.
+	GetUser(ctx context.Context, username string) (*User, error)
+
+	// GetUserByEmail returns the user with the given email, if there is
+	// no such user it returns ErrNotFound.
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+
+	// CreateUser stores the data of a new user. The username and the
+	// email are claimed atomically: if a user with the same name or
+	// email exists it returns ErrUserExists or ErrEmailExists and leaves
+	// the existing user untouched.
+	CreateUser(ctx context.Context, usr *User) error
+
+	// GetTimeline returns a page of about n posts in the timeline of the
+	// user with the given username, starting from the latest one
+	// published before the cursor. A cursor of 0 starts from the newest
+	// post. It also returns the cursor of the next page, 0 if there are
+	// no older posts. Posts published in the same second are never split
+	// between two pages.
+	GetTimeline(ctx context.Context, username string, before int64,
+		n int) ([]Post, int64, error)
+
+	// GetPost returns the post with the given name, if the post does not
+	// exist it returns ErrNotFound.
+	GetPost(ctx context.Context, name string) (*Post, error)
+
+	// AddPost stores the given post and adds it to the timeline of its
+	// author, to the feeds of the followers of its author and to the
+	// pages of its hashtags, at its publishing time. The feeds may be
+	// filled later, in the background.
+	AddPost(ctx context.Context, p *Post) error
+
+	// EditPost sets the text of the post with the name of p, edited at
+	// the Unix time t, keeping the previous text in the history of the
+	// post and moving the post to the pages of the hashtags of text. If
+	// the post does not exist it returns ErrNotFound.
+	EditPost(ctx context.Context, p *Post, text string, t int64) error
+
+	// DeletePost removes the post with the name of p, its comments, its
+	// likes, its mentions, its entries in the pages of its hashtags, in
+	// the feeds of the followers of p.AuthorName and in the timeline of
+	// p.AuthorName, scored at p.Time, at once. The feeds may be cleaned
+	// later, in the background, they skip deleted posts meanwhile.
+	// Missing records are ignored.
+	DeletePost(ctx context.Context, p *Post) error
+
+	// GetComments returns the comments on the posts with the given
+	// names, by post name.
+	GetComments(ctx context.Context, names []string) (map[string][]Comment,
+		error)
+
+	// AddComment adds c to the comments on p, at once, only if p takes
+	// comments. If p or the comment replied to do not exist it returns
+	// ErrNotFound, if p does not take comments it returns
+	// ErrCommentsOff.
+	AddComment(ctx context.Context, p *Post, c *Comment) error
+
+	// DeleteComments removes the comments on p with the given IDs.
+	// Missing comments are ignored.
+	DeleteComments(ctx context.Context, p *Post, ids []string) error
+
+	// SetCommentsOff turns the comments on p off, or back on. If the post
+	// does not exist it returns ErrNotFound.
+	SetCommentsOff(ctx context.Context, p *Post, off bool) error
+
+	// LikePost sets whether the user with the given name likes p, since
+	// the Unix time t, at once, and returns the number of users who like
+	// p. Liking a post twice counts once. If the post does not exist it
+	// returns ErrNotFound.
+	LikePost(ctx context.Context, p *Post, username string, like bool,
+		t int64) (int, error)
+
+	// GetLikers returns the sorted names of the users who like the posts
+	// with the given names, by post name.
+	GetLikers(ctx context.Context, names []string) (map[string][]string,
+		error)
+
+	// GetLikedPosts returns a page of the posts liked by the user with
+	// the given username, starting from the latest like, see
+	// GetTimeline. Deleted posts are left out.
+	GetLikedPosts(ctx context.Context, username string, before int64,
+		n int) ([]Post, int64, error)
+
+	// AddMentions records that the users with the given names are
+	// mentioned in p, or in its comments, since the Unix time t, at
+	// once. Users already mentioned in p keep their first mention. If
+	// the post does not exist it returns ErrNotFound.
+	AddMentions(ctx context.Context, p *Post, usernames []string,
+		t int64) error
+
+	// GetMentioned returns the names of the users mentioned in the posts
+	// with the given names, by post name.
+	GetMentioned(ctx context.Context, names []string) (map[string][]string,
+		error)
+
+	// GetMentionPosts returns a page of the posts that mention the user
+	// with the given username, starting from the latest mention, see
+	// GetTimeline. Deleted posts are left out.
+	GetMentionPosts(ctx context.Context, username string, before int64,
+		n int) ([]Post, int64, error)
+
+	// Follow sets whether the user with the given username follows the
+	// user other, since the Unix time t, at once. Following adds the
+	// latest posts of other to the feed of the user, unfollowing takes
+	// them all out. If other does not exist it returns ErrNotFound, if
+	// one of the users blocks the other following returns ErrBlocked.
+	Follow(ctx context.Context, username, other string, follow bool,
+		t int64) error
+
+	// IsFollowing reports whether the user with the given username
+	// follows the user other.
+	IsFollowing(ctx context.Context, username, other string) (bool, error)
+
+	// GetFollowCounts returns the number of followers of the user with
+	// the given username and the number of users they follow.
+	GetFollowCounts(ctx context.Context, username string) (int, int, error)
+
+	// GetFeed returns a page of the feed of the user with the given
+	// username, the posts of the users they follow, starting from the
+	// newest one, see GetTimeline. A feed keeps the latest feedLen posts.
+	// Deleted posts are left out.
+	GetFeed(ctx context.Context, username string, before int64,
+		n int) ([]Post, int64, error)
+
+	// Block sets whether the user with the given username blocks the
+	// user other, since the Unix time t, at once. Blocking also ends the
+	// follows between the two users, both ways, see Follow. If other
+	// does not exist it returns ErrNotFound.
+	Block(ctx context.Context, username, other string, block bool,
+		t int64) error
+
+	// Mute sets whether the user with the given username mutes the user
+	// other, since the Unix time t. If other does not exist it returns
+	// ErrNotFound.
+	Mute(ctx context.Context, username, other string, mute bool,
+		t int64) error
+
+	// GetBlocks returns the users blocked and muted by the user with the
+	// given username and the users who block them.
+	GetBlocks(ctx context.Context, username string) (*Blocks, error)
+
+	// GetTagPosts returns a page of the posts with the given folded
+	// hashtag, starting from the newest one, see GetTimeline.
+	GetTagPosts(ctx context.Context, tag string, before int64,
+		n int) ([]Post, int64, error)
+
+	// Snapshot returns a copy of all the data in the Store.
+	Snapshot(ctx context.Context) (*Snapshot, error)
+
+	// Restore writes the data in snap to the Store, overwriting records
+	// with the same keys and leaving the others alone, so restoring the
+	// same snapshot twice is harmless.
+	Restore(ctx context.Context, snap *Snapshot) error
+}
+
+// A scored member of a sorted set, like the ones of Redis.
+type scoredMember struct {
+	Score  int64
+	Member string
+}
+
+// A Like of a user for a post.
+type Like struct {
+	PostName string
+	UserName string
+	Time     int64 // Unix time of the like
+}
+
+// A Mention of a user in a post or in its comments.
+type Mention struct {
+	PostName string
+	UserName string
+	Time     int64 // Unix time of the first mention
+}
+
+// A Follow of a user for another user, by folded names.
+type Follow struct {
+	Follower string
+	Followed string
+	Time     int64 // Unix time of the follow
+}
+
+// A Relation of a user to another, like a block or a mute, by folded
+// names.
+type Relation struct {
+	From string
+	To   string
+	Time int64 // Unix time since the relation holds
+}
+
+// A Snapshot holds all the data of a Store, in a form that does not
+// depend on the backend.
+type Snapshot struct {
+	Version   int // Schema version
+	Users     []User
+	Posts     []Post
+	Comments  []Comment
+	Likes     []Like
+	Mentions  []Mention
+	Follows   []Follow
+	Blocks    []Relation
+	Mutes     []Relation
+	Timelines map[string][]scoredMember // By folded username
+	Feeds     map[string][]scoredMember // By folded username
+}
+
+// newStore creates the Store for the backend with the given name.
+func newStore(backend string) (Store, error) {
+	switch backend {
+	case "redis":
+		return newRedisStore(newPool(redisFlagsConfig()),
+			keyspace(*redisNamespace)), nil
+	case "memory":
+		return newMemoryStore(), nil
+	case "bolt":
+		return newBoltStore(*boltPath)
+	}
+	return nil, ErrUnknownStore
+}
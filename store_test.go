@@ -0,0 +1,35 @@
+/*
+Helpers for the tests of the Stores of GoPics.
+
+Copyright (c) 2015, Luca Chiricozzi. All rights reserved.
+Released under the MIT License.
+http://opensource.org/licenses/MIT
+*/
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// testStores returns an empty Store of every backend, by name. They are
+// closed at the end of the test. The Redis one is left out if no
+// redis-server can be reached.
+func testStores(t *testing.T) map[string]Store {
+	b, err := newBoltStore(filepath.Join(t.TempDir(), "gopics.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.db.Close() })
+
+	stores := map[string]Store{
+		"memory": newMemoryStore(),
+		"bolt":   b,
+	}
+	if cfg, err := testRedisAddr(); err != nil {
+		t.Logf("skipping redis: no redis-server at %s: %v", cfg.Addr, err)
+	} else {
+		stores["redis"] = testRedisStore(t, cfg)
+	}
+	return stores
+}
@@ -8,11 +8,12 @@ http://opensource.org/licenses/MIT
 package main
 
 import (
+	"context"
 	"strings"
 
-	"github.com/garyburd/redigo/redis"
 	"github.com/lucachr/gopics/reutils"
 	"github.com/ungerik/go-gravatar"
+	"golang.org/x/text/cases"
 )
 
 // An user of the image board
@@ -21,33 +22,39 @@ type User struct {
 	Email    string `redis:"email"`
 	Password []byte `redis:"password"`
 	PicURL   string `redis:"pic_url"`
-	Posts    []Post `redis:"-"`
+	Posts    []Post `redis:"-" json:"-"`
 }
 
 // validate is a convenience method for validating user data.
-func (usr *User) validate(conn redis.Conn) error {
+func (usr *User) validate(ctx context.Context, s Store) error {
 	if !reutils.MatchName(usr.Name) {
 		return ErrValidation("Your username is invalid!")
 	}
 
-	for _, name := range invalidUser {
-		if strings.Contains(usr.Name, name) {
-			return ErrValidation("You cannot choose that name!")
-		}
+	if reservedName(usr.Name) {
+		return ErrValidation("You cannot choose that name!")
 	}
 
-	reg, err := redisGetUser(conn, usr.Name)
-	if err != nil && err != redis.ErrNil {
+	reg, err := s.GetUser(ctx, usr.Name)
+	if err != nil && err != ErrNotFound {
 		return err
 	}
 	if reg != nil {
-		return ErrValidation("A user with the same name already exist!")
+		return ErrUserExists
 	}
 
 	if !reutils.MatchEmail(usr.Email) {
 		return ErrValidation("Your email is invalid!")
 	}
 
+	reg, err = s.GetUserByEmail(ctx, usr.Email)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	if reg != nil {
+		return ErrEmailExists
+	}
+
 	if len(usr.Password) < 8 {
 		return ErrValidation("Your password is too short!")
 	}
@@ -55,10 +62,48 @@ func (usr *User) validate(conn redis.Conn) error {
 	return nil
 }
 
-// save is a convenience method for adding a new user.
-func (usr *User) save(conn redis.Conn) error {
+// save is a convenience method for adding a new user, it returns
+// ErrUserExists or ErrEmailExists if another user took the name or the
+// email after validate.
+func (usr *User) save(ctx context.Context, s Store) error {
+	usr.Email = foldEmail(usr.Email)
 	usr.PicURL = gravatar.Url(usr.Email)
 
-	_, err := conn.Do("HMSET", redisFlat(userTag+usr.Name, usr)...)
-	return err
+	return s.CreateUser(ctx, usr)
+}
+
+// reservedName reports whether nobody can register the given username,
+// see invalidUser and reservedNames.
+func reservedName(username string) bool {
+	name := foldName(username)
+	for _, invalid := range invalidUser {
+		if strings.Contains(name, invalid) {
+			return true
+		}
+	}
+	for _, reserved := range reservedNames {
+		if name == reserved {
+			return true
+		}
+	}
+	return false
+}
+
+// fold returns s with Unicode full case folding, so "Straße" and
+// "STRASSE" fold alike.
+func fold(s string) string {
+	return cases.Fold().String(s)
+}
+
+// foldName returns the case folded form of a username. Users are looked
+// up by their folded name, so names that differ only by case belong to
+// the same user, while the name keeps the case chosen at registration.
+func foldName(name string) string {
+	return fold(name)
+}
+
+// foldEmail returns the case folded form of an email, emails are unique
+// in their folded form.
+func foldEmail(email string) string {
+	return fold(email)
 }
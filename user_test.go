@@ -0,0 +1,122 @@
+/*
+Tests of GoPics' users.
+
+Copyright (c) 2015, Luca Chiricozzi. All rights reserved.
+Released under the MIT License.
+http://opensource.org/licenses/MIT
+*/
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// flipCase returns s with the case of its i-th letter flipped for every
+// bit i set in n, so different n give names equal once case folded.
+func flipCase(s string, n int) string {
+	r := []rune(s)
+	for i := range r {
+		if n&(1<<uint(i)) == 0 {
+			continue
+		}
+		if up := strings.ToUpper(string(r[i])); up != string(r[i]) {
+			r[i] = []rune(up)[0]
+		} else {
+			r[i] = []rune(strings.ToLower(string(r[i])))[0]
+		}
+	}
+	return string(r)
+}
+
+// TestConcurrentCreateUser registers the same user from many goroutines
+// at once: exactly one registration must succeed, the others must lose
+// with ErrUserExists or ErrEmailExists.
+func TestConcurrentCreateUser(t *testing.T) {
+	const n = 32
+
+	tests := []struct {
+		name string
+		user func(i int) *User
+		lost error
+	}{
+		{
+			"same name",
+			func(i int) *User {
+				return &User{Name: "alice",
+					Email: "alice" + strconv.Itoa(i) + "@example.com"}
+			},
+			ErrUserExists,
+		},
+		{
+			"name case",
+			func(i int) *User {
+				return &User{Name: flipCase("alice", i),
+					Email: "alice" + strconv.Itoa(i) + "@example.com"}
+			},
+			ErrUserExists,
+		},
+		{
+			"email case",
+			func(i int) *User {
+				return &User{Name: "alice" + strconv.Itoa(i),
+					Email: flipCase("alice@example.com", i)}
+			},
+			ErrEmailExists,
+		},
+	}
+
+	for _, tt := range tests {
+		for backend, s := range testStores(t) {
+			var wg sync.WaitGroup
+			start := make(chan struct{})
+			errs := make(chan error, n)
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(usr *User) {
+					defer wg.Done()
+					<-start
+					errs <- s.CreateUser(context.Background(), usr)
+				}(tt.user(i))
+			}
+			close(start)
+			wg.Wait()
+			close(errs)
+
+			created := 0
+			for err := range errs {
+				switch err {
+				case nil:
+					created++
+				case tt.lost:
+				default:
+					t.Errorf("%s, %s: got %v, want nil or %v", tt.name,
+						backend, err, tt.lost)
+				}
+			}
+			if created != 1 {
+				t.Errorf("%s, %s: %d users created, want 1", tt.name,
+					backend, created)
+			}
+		}
+	}
+}
+
+// TestFoldName checks that names equal under Unicode case folding, not
+// only under lower casing, fold alike.
+func TestFoldName(t *testing.T) {
+	for _, names := range [][2]string{
+		{"Alice", "aLICE"},
+		{"Straße", "STRASSE"},
+		{"ΟΔΟΣ", "οδος"},
+		{"ﬁsh", "FISH"},
+	} {
+		if foldName(names[0]) != foldName(names[1]) {
+			t.Errorf("foldName(%q) = %q, foldName(%q) = %q, want equal",
+				names[0], foldName(names[0]), names[1], foldName(names[1]))
+		}
+	}
+}
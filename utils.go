@@ -9,14 +9,61 @@ http://opensource.org/licenses/MIT
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"html/template"
+	"io"
+	"net"
 	"net/http"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/garyburd/redigo/redis"
 	"github.com/lucachr/gopics/flash"
 )
 
+// renderPage executes a template with the data contained in the given
+// page and returns the result.
+func renderPage(tmpl string, p *Page) (*renderedPage, *appError) {
+	buf := new(bytes.Buffer)
+	err := templates.ExecuteTemplate(buf, tmpl+".html", p)
+	if err != nil {
+		return nil, &appError{
+			Err:  err,
+			Code: http.StatusInternalServerError,
+		}
+	}
+
+	sum := sha1.Sum(buf.Bytes())
+	return &renderedPage{
+		Body: buf.Bytes(),
+		ETag: `"` + hex.EncodeToString(sum[:]) + `"`,
+	}, nil
+}
+
+// writePage sends a rendered page with its ETag, or only a Not Modified
+// status if the client already has it.
+func writePage(w http.ResponseWriter, r *http.Request, page *renderedPage) {
+	// The page depends on the logged user.
+	w.Header().Set("Vary", "Cookie")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", page.ETag)
+
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if strings.TrimSpace(tag) == page.ETag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page.Body)
+}
+
 // renderTemplate executes a template with the data contained in the given
 // page.
 func renderTemplate(w http.ResponseWriter, tmpl string, p *Page) *appError {
@@ -32,11 +79,72 @@ func renderTemplate(w http.ResponseWriter, tmpl string, p *Page) *appError {
 }
 
 // httpAppError send an error reponse to the user if
-// is not nil.
+// is not nil. When the store is unavailable or read-only, it shows a
+// page asking to retry later.
 func httpAppError(w http.ResponseWriter, ae *appError) {
-	if ae != nil {
+	if ae == nil {
+		return
+	}
+	if ae.Code != http.StatusServiceUnavailable {
 		http.Error(w, ae.Error(), ae.Code)
+		return
+	}
+
+	// Writes are refused while the store is read-only.
+	tmpl := "unavailable.html"
+	if ae.Err == ErrReadOnly {
+		tmpl = "readonly.html"
+	}
+
+	buf := new(bytes.Buffer)
+	p := &Page{Title: pageTitle + "Unavailable"}
+	if err := templates.ExecuteTemplate(buf, tmpl, p); err != nil {
+		http.Error(w, ae.Error(), ae.Code)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.WriteHeader(ae.Code)
+	w.Write(buf.Bytes())
+}
+
+// storeError wraps an error returned by a Store. Errors caused by an
+// unavailable backend or a canceled request are reported as 503, any
+// other as 500.
+func storeError(err error) *appError {
+	code := http.StatusInternalServerError
+	if err == context.Canceled || unavailable(err) {
+		code = http.StatusServiceUnavailable
+	}
+	return &appError{
+		Err:  err,
+		Code: code,
+	}
+}
+
+// unavailable reports whether err is caused by a backend that is down,
+// unreachable, too busy or too slow to answer.
+func unavailable(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	switch err {
+	case ErrUnavailable, context.DeadlineExceeded, redis.ErrPoolExhausted,
+		io.EOF, io.ErrUnexpectedEOF:
+		return true
+	}
+	return false
+}
+
+// withTimeout returns r with a context that expires after
+// requestTimeout, and the function that releases it.
+func withTimeout(r *http.Request) (*http.Request, context.CancelFunc) {
+	if *requestTimeout <= 0 {
+		ctx, cancel := context.WithCancel(r.Context())
+		return r.WithContext(ctx), cancel
 	}
+	ctx, cancel := context.WithTimeout(r.Context(), *requestTimeout)
+	return r.WithContext(ctx), cancel
 }
 
 // unixTimeNow returns the current Unix time.